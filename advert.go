@@ -13,6 +13,7 @@ import (
 	"net/textproto"
 	"net/url"
 	"strings"
+	"time"
 )
 
 func newAdvert(method, host string, hdr http.Header) *http.Request {
@@ -29,9 +30,23 @@ func newAdvert(method, host string, hdr http.Header) *http.Request {
 
 // We cannot use http.Request.Write due to golang.org/issue/5684.
 func marshalAdvert(buf *bytes.Buffer, req *http.Request) error {
-	fmt.Fprintf(buf, "%s %s %s\r\n", req.Method, "*", req.Proto)
-	fmt.Fprintf(buf, "Host: %s\r\n", req.Host)
-	if err := req.Header.WriteSubset(buf, nil); err != nil {
+	return marshalOrderedAdvert(buf, req, nil)
+}
+
+// marshalOrderedAdvert writes req in the order and casing of the
+// header fields of orig, the header of the original message.
+func marshalOrderedAdvert(buf *bytes.Buffer, req *http.Request, orig Header) error {
+	return marshalHeaderAdvert(buf, req.Method, req.Host, orig.merge(req.Header, req.Host))
+}
+
+// marshalHeaderAdvert writes the message with the header h as is. It
+// adds HOST field when h has none.
+func marshalHeaderAdvert(buf *bytes.Buffer, method, host string, h Header) error {
+	fmt.Fprintf(buf, "%s * HTTP/1.1\r\n", method)
+	if h.Get("Host") == "" {
+		fmt.Fprintf(buf, "HOST: %s\r\n", host)
+	}
+	if err := h.Write(buf); err != nil {
 		return err
 	}
 	if _, err := buf.WriteString("\r\n"); err != nil {
@@ -97,10 +112,16 @@ func parseRequestLine(l string) (method, requestURI, proto string, ok bool) {
 // An AdvertRedirector represents a SSDP advertisement message
 // redirector.
 type AdvertRedirector struct {
-	conn // network connection endpoint
-	mifs []net.Interface
-	path *path // reverse path
-	req  *http.Request
+	conn  // network connection endpoint
+	mifs  []net.Interface
+	path  *path // reverse path
+	req   *http.Request
+	raw   []byte       // received message
+	at    time.Time    // receive time
+	devs  []Deviation  // deviations found in received message
+	guard *loopGuard   // loop prevention
+	srch  *searchTable // forwarded searches
+	reg   bool         // whether the search has been registered
 }
 
 // Header returns the HTTP header map that will be sent by WriteTo
@@ -109,18 +130,51 @@ func (rdr *AdvertRedirector) Header() http.Header {
 	return rdr.req.Header
 }
 
+// Method returns the method of the SSDP advertisement message, which
+// is either NOTIFY or M-SEARCH.
+func (rdr *AdvertRedirector) Method() string {
+	return rdr.req.Method
+}
+
+// Raw returns the received SSDP advertisement message as is.
+func (rdr *AdvertRedirector) Raw() []byte {
+	return rdr.raw
+}
+
+// ReceivedTime returns the time when the SSDP advertisement message
+// was received.
+func (rdr *AdvertRedirector) ReceivedTime() time.Time {
+	return rdr.at
+}
+
+// Deviations returns the deviations from the protocol found in the
+// received SSDP advertisement message. It returns nil when the
+// message conforms to the protocol or is parsed in ParseStrict mode.
+func (rdr *AdvertRedirector) Deviations() []Deviation {
+	return rdr.devs
+}
+
 // WriteTo writes the SSDP advertisement message. The outbound network
 // interface ifi is used for sending multicast message. It uses the
-// system assigned multicast network interface when ifi is nil.
+// system assigned multicast network interface when ifi is nil. The
+// selection of ifi doesn't affect concurrent writes on the same
+// endpoint. The header fields keep the order and casing of the
+// received message; added fields follow them. The message carries a
+// private hop header for the loop prevention. When the message is a
+// M-SEARCH message, the redirector remembers the requester and relays
+// responses back to it until MX seconds elapse.
 func (rdr *AdvertRedirector) WriteTo(dst *net.UDPAddr, ifi *net.Interface) (int, error) {
-	if ifi != nil {
-		rdr.SetMulticastInterface(ifi)
+	if rdr.srch != nil && !rdr.reg {
+		rdr.reg = true
+		rdr.srch.register(rdr.req, rdr.path.src, rdr.path.ifIndex, unicastReply(rdr.conn, rdr.path.src))
 	}
+	rdr.guard.stamp(rdr.req.Header)
 	var buf bytes.Buffer
-	if err := marshalAdvert(&buf, rdr.req); err != nil {
+	if err := marshalOrderedAdvert(&buf, rdr.req, parseHeader(rdr.raw)); err != nil {
 		return 0, err
 	}
-	return rdr.writeTo(buf.Bytes(), dst)
+	rdr.guard.record(buf.Bytes())
+	return rdr.writeTo(buf.Bytes(), dst, ifi)
 }
 
 // ForwardPath returns the destination address of the SSDP
@@ -143,8 +197,8 @@ func newAdvertRedirector(conn conn, mifs []net.Interface, grp *net.UDPAddr, path
 		req:  req,
 	}
 	path.dst.Port = grp.Port
-	if ipv6LinkLocal(path.src.IP) {
-		path.src.Zone = interfaceByIndex(mifs, path.ifIndex).Name
+	if ifi := interfaceByIndex(mifs, path.ifIndex); ifi != nil && ipv6LinkLocal(path.src.IP) {
+		path.src.Zone = ifi.Name
 	}
 	return rdr
 }
@@ -0,0 +1,8 @@
+// Copyright 2014 Mikio Hara. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ssdp
+
+// Messages are read and written in batches with recvmmsg and sendmmsg.
+const batchIO = true
@@ -0,0 +1,10 @@
+// Copyright 2014 Mikio Hara. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !linux
+
+package ssdp
+
+// Messages are read and written one by one.
+const batchIO = false
@@ -0,0 +1,143 @@
+// Copyright 2014 Mikio Hara. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ssdp
+
+import (
+	"errors"
+	"log"
+	"log/slog"
+	"net"
+	"net/http"
+)
+
+// A Bridge represents a pair of redirectors that translates SSDP
+// messages between an IPv4 group and an IPv6 group.
+type Bridge struct {
+	// ErrorLog specified an optional logger for errors. If it is
+	// nil, logging goes to os.Stderr via the log package's
+	// standard logger.
+	ErrorLog *log.Logger
+
+	// Logger optionally specifies a structured logger. If it is
+	// not nil, it is used instead of ErrorLog.
+	Logger *slog.Logger
+
+	// RewriteLocation optionally specifies a function that
+	// rewrites the LOCATION header of messages translated to the
+	// other address family. The ipv6 parameter reports whether
+	// the message is going to be sent over IPv6.
+	RewriteLocation func(loc string, ipv6 bool) string
+
+	v4 *Redirector
+	v6 *Redirector
+}
+
+// ListenBridge listens on the IPv4 group of ln4 and the IPv6 group of
+// ln6, and returns a bridge. If ln6.Group is empty,
+// DefaultIPv6LinkLocalGroup will be used. If mifs is nil, it tries to
+// listen on all available multicast network interfaces.
+func ListenBridge(ln4, ln6 *Listener, mifs []net.Interface) (*Bridge, error) {
+	if ln6.Group == "" {
+		ln6.Group = DefaultIPv6LinkLocalGroup
+	}
+	v4, err := ln4.ListenRedirector(mifs)
+	if err != nil {
+		return nil, err
+	}
+	if v4.group.IP.To4() == nil {
+		v4.Close()
+		return nil, errors.New("no IPv4 group")
+	}
+	v6, err := ln6.ListenRedirector(mifs)
+	if err != nil {
+		v4.Close()
+		return nil, err
+	}
+	if v6.group.IP.To4() != nil {
+		v4.Close()
+		v6.Close()
+		return nil, errors.New("no IPv6 group")
+	}
+	v6.guard = v4.guard // both sides share the identity for the loop prevention
+	return &Bridge{v4: v4, v6: v6}, nil
+}
+
+// Serve starts to translate SSDP messages between the groups. It
+// returns when either of the redirectors fails.
+func (br *Bridge) Serve() error {
+	errCh := make(chan error, 2)
+	go func() {
+		errCh <- br.v4.Serve(&bridgeHandler{br: br, from: br.v4, to: br.v6})
+	}()
+	go func() {
+		errCh <- br.v6.Serve(&bridgeHandler{br: br, from: br.v6, to: br.v4})
+	}()
+	return <-errCh
+}
+
+// IPv4 returns the IPv4 side redirector.
+func (br *Bridge) IPv4() *Redirector {
+	return br.v4
+}
+
+// IPv6 returns the IPv6 side redirector.
+func (br *Bridge) IPv6() *Redirector {
+	return br.v6
+}
+
+// Close closes the bridge.
+func (br *Bridge) Close() error {
+	err := br.v4.Close()
+	if err6 := br.v6.Close(); err == nil {
+		err = err6
+	}
+	return err
+}
+
+func (br *Bridge) rewriteLocation(hdr http.Header, ipv6 bool) {
+	if br.RewriteLocation == nil {
+		return
+	}
+	if loc := hdr.Get("Location"); loc != "" {
+		hdr.Set("Location", br.RewriteLocation(loc, ipv6))
+	}
+}
+
+func (br *Bridge) logEvent(r logRecord) {
+	writeLog(br.Logger, br.ErrorLog, &r)
+}
+
+type bridgeHandler struct {
+	br   *Bridge
+	from *Redirector // inbound side
+	to   *Redirector // outbound side
+}
+
+// RedirectAdvert translates the advertisement message to the group of
+// the outbound side.
+func (bh *bridgeHandler) RedirectAdvert(adv *AdvertRedirector) {
+	ipv6 := bh.to.group.IP.To4() == nil
+	req := *adv.req
+	req.Host = bh.to.group.String()
+	bh.br.rewriteLocation(req.Header, ipv6)
+	// The interface indices of both sides are of the same host, so
+	// the requester is registered as non-local.
+	bh.to.srch.register(&req, adv.path.src, 0, unicastReply(bh.from.conn, adv.path.src))
+	out := newAdvertRedirector(bh.to.conn, bh.to.mifs, bh.to.group, &path{src: adv.path.src, dst: &net.UDPAddr{IP: bh.to.group.IP}}, &req)
+	out.raw = adv.raw
+	out.guard = bh.to.guard
+	for i := range bh.to.mifs {
+		ifi := &bh.to.mifs[i]
+		if _, err := out.WriteTo(bh.to.group, ifi); err != nil {
+			bh.br.logEvent(logRecord{level: slog.LevelWarn, kind: LogKindWrite, msg: "translate advert failed", path: &path{src: adv.path.src, ifIndex: ifi.Index}, mifs: bh.to.mifs, method: req.Method, hdr: req.Header, err: err})
+		}
+	}
+}
+
+// RedirectResponse prepares the response for the requester on the
+// other side. The outbound side redirector relays it.
+func (bh *bridgeHandler) RedirectResponse(resp *ResponseRedirector) {
+	bh.br.rewriteLocation(resp.Header(), bh.to.group.IP.To4() == nil)
+}
@@ -0,0 +1,69 @@
+// Copyright 2014 Mikio Hara. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ssdp
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBridge(t *testing.T) {
+	if !supportsIPv4 || !supportsIPv6 {
+		t.Skip("both IPv4 and IPv6 are required")
+	}
+	ln4 := Listener{Port: "1904", LocalPort: "1904", MulticastLoopback: true}
+	ln6 := Listener{Port: "1904", LocalPort: "1904", MulticastLoopback: true}
+	br, err := ListenBridge(&ln4, &ln6, nil)
+	if err != nil {
+		t.Skip(err)
+	}
+	defer br.Close()
+	br.RewriteLocation = func(loc string, ipv6 bool) string {
+		if ipv6 {
+			return strings.Replace(loc, "192.0.2.1", "[2001:db8::1]", 1)
+		}
+		return loc
+	}
+	go br.Serve()
+
+	cpln := Listener{Group: DefaultIPv6LinkLocalGroup, Port: "1904", LocalPort: "1904"}
+	cp, err := cpln.ListenControlPoint(br.IPv6().Interfaces())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cp.Close()
+	ch := make(chan *http.Request, 1)
+	go cp.Serve(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		select {
+		case ch <- req:
+		default:
+		}
+	}))
+
+	c, err := net.ListenPacket("udp4", "0.0.0.0:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	dst := &net.UDPAddr{IP: br.IPv4().GroupAddr().IP, Port: 1904}
+	msg := "NOTIFY * HTTP/1.1\r\nHOST: 239.255.255.250:1900\r\nLOCATION: http://192.0.2.1/dd.xml\r\nNT: upnp:rootdevice\r\nNTS: ssdp:alive\r\nUSN: uuid:x::upnp:rootdevice\r\n\r\n"
+	if _, err := c.WriteTo([]byte(msg), dst); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case req := <-ch:
+		if req.Host != br.IPv6().GroupAddr().String() {
+			t.Errorf("got %v; want %v", req.Host, br.IPv6().GroupAddr())
+		}
+		if loc := req.Header.Get("Location"); loc != "http://[2001:db8::1]/dd.xml" {
+			t.Errorf("got %v; want http://[2001:db8::1]/dd.xml", loc)
+		}
+	case <-time.After(time.Second):
+		t.Skip("no translated message received")
+	}
+}
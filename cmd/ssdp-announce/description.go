@@ -0,0 +1,83 @@
+// Copyright 2014 Mikio Hara. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/xml"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const descriptionPath = "/description.xml"
+
+type descRoot struct {
+	XMLName     xml.Name   `xml:"urn:schemas-upnp-org:device-1-0 root"`
+	ConfigID    int        `xml:"configId,attr"`
+	SpecVersion descSpec   `xml:"specVersion"`
+	Device      descDevice `xml:"device"`
+}
+
+type descSpec struct {
+	Major int `xml:"major"`
+	Minor int `xml:"minor"`
+}
+
+type descDevice struct {
+	DeviceType   string        `xml:"deviceType"`
+	FriendlyName string        `xml:"friendlyName"`
+	Manufacturer string        `xml:"manufacturer"`
+	ModelName    string        `xml:"modelName"`
+	UDN          string        `xml:"UDN"`
+	Services     []descService `xml:"serviceList>service,omitempty"`
+}
+
+type descService struct {
+	ServiceType string `xml:"serviceType"`
+	ServiceID   string `xml:"serviceId"`
+	SCPDURL     string `xml:"SCPDURL"`
+	ControlURL  string `xml:"controlURL"`
+	EventSubURL string `xml:"eventSubURL"`
+}
+
+func marshalDescription(sp *spec) ([]byte, error) {
+	root := descRoot{
+		ConfigID:    sp.ConfigID,
+		SpecVersion: descSpec{Major: 1, Minor: 1},
+		Device: descDevice{
+			DeviceType:   sp.Types[0],
+			FriendlyName: sp.FriendlyName,
+			Manufacturer: sp.Manufacturer,
+			ModelName:    sp.ModelName,
+			UDN:          "uuid:" + sp.UUID,
+		},
+	}
+	for i, t := range sp.Services {
+		name := t
+		if ss := strings.Split(t, ":"); len(ss) > 1 {
+			name = ss[len(ss)-2]
+		}
+		n := strconv.Itoa(i)
+		root.Device.Services = append(root.Device.Services, descService{
+			ServiceType: t,
+			ServiceID:   "urn:upnp-org:serviceId:" + name,
+			SCPDURL:     "/scpd/" + n + ".xml",
+			ControlURL:  "/control/" + n,
+			EventSubURL: "/event/" + n,
+		})
+	}
+	b, err := xml.MarshalIndent(&root, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), b...), nil
+}
+
+func descriptionHandler(b []byte) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", `text/xml; charset="utf-8"`)
+		w.Write(b)
+	})
+}
@@ -0,0 +1,272 @@
+// Copyright 2014 Mikio Hara. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Ssdp-announce runs a fake SSDP device.
+//
+// Usage:
+//
+//	ssdp-announce [flags] spec-file
+//
+// The spec file is a YAML or JSON document that describes the
+// device, for example:
+//
+//	uuid: 2fac1234-31f8-11b4-a222-08002b34c003
+//	types:
+//	- urn:schemas-upnp-org:device:MediaServer:1
+//	services:
+//	- urn:schemas-upnp-org:service:ContentDirectory:1
+//	- urn:schemas-upnp-org:service:ConnectionManager:1
+//	max-age: 1800
+//
+// It announces the device, answers M-SEARCH messages and, if
+// requested, serves a generated device description. The device says
+// goodbye when interrupted. An ssdp:all search is answered with one
+// response per target.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mikioh/ssdp"
+)
+
+var (
+	ifnames   = flag.String("i", "", "comma-separated list of network interfaces; all available multicast interfaces when empty")
+	group     = flag.String("g", ssdp.DefaultIPv4Group, "multicast group")
+	localPort = flag.String("port", "", "local port; "+ssdp.DefaultPort+" when empty")
+	loopback  = flag.Bool("loopback", false, "loop back outgoing multicast messages to the local host")
+	httpAddr  = flag.String("http", "", "serve the generated device description on the address")
+	interval  = flag.Duration("interval", 0, "announcement interval; half of max-age when zero")
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s [flags] spec-file\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	log.SetFlags(0)
+	log.SetPrefix("ssdp-announce: ")
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	sp, err := readSpec(flag.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	if sp.Location == "" && *httpAddr == "" {
+		log.Fatal("either location in spec or -http flag is required")
+	}
+	var mifs []net.Interface
+	if *ifnames != "" {
+		for _, name := range strings.Split(*ifnames, ",") {
+			ifi, err := net.InterfaceByName(strings.TrimSpace(name))
+			if err != nil {
+				log.Fatal(err)
+			}
+			mifs = append(mifs, *ifi)
+		}
+	}
+	ln := ssdp.Listener{Group: *group, LocalPort: *localPort, MulticastLoopback: *loopback}
+	dev, err := ln.ListenDevice(mifs)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer dev.Close()
+
+	if *httpAddr != "" {
+		b, err := marshalDescription(sp)
+		if err != nil {
+			log.Fatal(err)
+		}
+		mux := http.NewServeMux()
+		mux.Handle(descriptionPath, descriptionHandler(b))
+		go func() {
+			log.Fatal(http.ListenAndServe(*httpAddr, mux))
+		}()
+	}
+
+	a := &announcer{dev: dev, spec: sp}
+	if err := a.prepare(); err != nil {
+		log.Fatal(err)
+	}
+	go dev.Serve(a)
+	a.announce("ssdp:alive")
+	d := *interval
+	if d <= 0 {
+		d = time.Duration(sp.MaxAge) * time.Second / 2
+	}
+	t := time.NewTicker(d)
+	defer t.Stop()
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt)
+	for {
+		select {
+		case <-t.C:
+			a.announce("ssdp:alive")
+		case <-sig:
+			a.announce("ssdp:byebye")
+			return
+		}
+	}
+}
+
+type announcer struct {
+	dev  *ssdp.Device
+	spec *spec
+	msgs map[string]*announcement // prepared messages by NTS
+}
+
+// An announcement represents the prepared messages for all targets.
+type announcement struct {
+	pms  []*ssdp.PreparedMessage
+	usns []string // USN of each message on each interface
+}
+
+func (a *announcer) location(ifi *net.Interface) string {
+	if a.spec.Location != "" {
+		return a.spec.Location
+	}
+	host, port, err := net.SplitHostPort(*httpAddr)
+	if err != nil {
+		return ""
+	}
+	if ip := net.ParseIP(host); ip == nil || ip.IsUnspecified() {
+		host = interfaceAddr(ifi, a.dev.GroupAddr().IP.To4() != nil)
+	}
+	return "http://" + net.JoinHostPort(host, port) + descriptionPath
+}
+
+func (a *announcer) header(t target, nts string) http.Header {
+	hdr := make(http.Header)
+	hdr.Set("Nt", t.nt)
+	hdr.Set("Nts", nts)
+	hdr.Set("Usn", t.usn)
+	hdr.Set("Bootid.upnp.org", strconv.Itoa(a.spec.BootID))
+	hdr.Set("Configid.upnp.org", strconv.Itoa(a.spec.ConfigID))
+	if nts == "ssdp:alive" {
+		hdr.Set("Cache-Control", "max-age="+strconv.Itoa(a.spec.MaxAge))
+		hdr.Set("Server", a.spec.Server)
+	}
+	return hdr
+}
+
+// prepare encodes the messages for all targets on all interfaces
+// once, as they don't change between announcements.
+func (a *announcer) prepare() error {
+	a.msgs = make(map[string]*announcement)
+	for _, nts := range []string{"ssdp:alive", "ssdp:byebye"} {
+		var location func(*net.Interface) string
+		if nts == "ssdp:alive" {
+			location = a.location
+		}
+		an := &announcement{}
+		for _, t := range a.spec.targets() {
+			pm, err := a.dev.PrepareNotify(ssdp.Notification{Header: ssdp.HeaderFromHTTP(a.header(t, nts)), Interfaces: a.dev.Interfaces(), Location: location})
+			if err != nil {
+				return err
+			}
+			an.pms = append(an.pms, pm)
+			for range pm.Interfaces() {
+				an.usns = append(an.usns, t.usn)
+			}
+		}
+		a.msgs[nts] = an
+	}
+	return nil
+}
+
+func (a *announcer) announce(nts string) {
+	an := a.msgs[nts]
+	srs, err := a.dev.NotifyPrepared(an.pms...)
+	if err != nil && len(srs) == 0 {
+		log.Println(err)
+		return
+	}
+	for i, sr := range srs {
+		if sr.Err != nil {
+			log.Printf("%s on %s: %v", an.usns[i], sr.Interface.Name, sr.Err)
+		}
+	}
+}
+
+// ServeHTTP responds to M-SEARCH messages.
+func (a *announcer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Header.Get("Man") != `"ssdp:discover"` {
+		return
+	}
+	st := req.Header.Get("St")
+	var ts []target
+	for _, t := range a.spec.targets() {
+		if st == "ssdp:all" || t.nt == st {
+			ts = append(ts, t)
+		}
+	}
+	if len(ts) == 0 {
+		return
+	}
+	if mx, err := strconv.Atoi(req.Header.Get("Mx")); err == nil && mx > 0 {
+		if mx > 5 {
+			mx = 5
+		}
+		time.Sleep(time.Duration(rand.Int63n(int64(mx) * int64(time.Second))))
+	}
+	ifi := ssdp.InterfaceFromContext(req.Context())
+	if mifs := a.dev.Interfaces(); ifi == nil && len(mifs) > 0 {
+		ifi = &mifs[0]
+	}
+	for _, t := range ts {
+		hdr := make(http.Header)
+		hdr.Set("Cache-Control", "max-age="+strconv.Itoa(a.spec.MaxAge))
+		hdr.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+		hdr.Set("Ext", "")
+		hdr.Set("Location", a.location(ifi))
+		hdr.Set("Server", a.spec.Server)
+		hdr.Set("St", t.nt)
+		hdr.Set("Usn", t.usn)
+		hdr.Set("Bootid.upnp.org", strconv.Itoa(a.spec.BootID))
+		hdr.Set("Configid.upnp.org", strconv.Itoa(a.spec.ConfigID))
+		if err := a.dev.Respond(req, ssdp.HeaderFromHTTP(hdr)); err != nil {
+			log.Printf("%s to %s: %v", t.usn, req.RemoteAddr, err)
+		}
+	}
+}
+
+func interfaceAddr(ifi *net.Interface, ipv4 bool) string {
+	if ifi == nil {
+		return ""
+	}
+	ifat, err := ifi.Addrs()
+	if err != nil {
+		return ""
+	}
+	for _, ifa := range ifat {
+		ipn, ok := ifa.(*net.IPNet)
+		if !ok || ipn.IP.IsLoopback() && ifi.Flags&net.FlagLoopback == 0 {
+			continue
+		}
+		if ipv4 && ipn.IP.To4() != nil {
+			return ipn.IP.String()
+		}
+		if !ipv4 && ipn.IP.To4() == nil {
+			if ipn.IP.IsLinkLocalUnicast() {
+				return ipn.IP.String() + "%25" + ifi.Name // zone in URL
+			}
+			return ipn.IP.String()
+		}
+	}
+	return ""
+}
@@ -0,0 +1,85 @@
+// Copyright 2014 Mikio Hara. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// A spec represents a device specification.
+type spec struct {
+	UUID     string   `json:"uuid" yaml:"uuid"`         // device UUID without "uuid:" prefix
+	Types    []string `json:"types" yaml:"types"`       // device types, the first one is the root device type
+	Services []string `json:"services" yaml:"services"` // service types
+	Location string   `json:"location" yaml:"location"` // LOCATION header; generated when empty
+	MaxAge   int      `json:"max-age" yaml:"max-age"`   // advertisement duration in seconds
+	Server   string   `json:"server" yaml:"server"`     // SERVER header
+	BootID   int      `json:"boot-id" yaml:"boot-id"`   // BOOTID.UPNP.ORG header
+	ConfigID int      `json:"config-id" yaml:"config-id"`
+
+	FriendlyName string `json:"friendly-name" yaml:"friendly-name"`
+	Manufacturer string `json:"manufacturer" yaml:"manufacturer"`
+	ModelName    string `json:"model-name" yaml:"model-name"`
+}
+
+func readSpec(filename string) (*spec, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var sp spec
+	if strings.ToLower(filepath.Ext(filename)) == ".json" {
+		err = json.Unmarshal(b, &sp)
+	} else {
+		err = yaml.UnmarshalStrict(b, &sp)
+	}
+	if err != nil {
+		return nil, err
+	}
+	sp.UUID = strings.TrimPrefix(sp.UUID, "uuid:")
+	if sp.UUID == "" {
+		return nil, errors.New("missing uuid")
+	}
+	if len(sp.Types) == 0 {
+		return nil, errors.New("missing device type")
+	}
+	if sp.MaxAge <= 0 {
+		sp.MaxAge = 1800
+	}
+	if sp.Server == "" {
+		sp.Server = "Go/1 UPnP/1.1 ssdp-announce/1"
+	}
+	if sp.FriendlyName == "" {
+		sp.FriendlyName = "ssdp-announce " + sp.UUID
+	}
+	return &sp, nil
+}
+
+// A target represents a notification or search target.
+type target struct {
+	nt  string // NT or ST header
+	usn string // USN header
+}
+
+func (sp *spec) targets() []target {
+	udn := "uuid:" + sp.UUID
+	ts := []target{
+		{nt: "upnp:rootdevice", usn: udn + "::upnp:rootdevice"},
+		{nt: udn, usn: udn},
+	}
+	for _, t := range sp.Types {
+		ts = append(ts, target{nt: t, usn: udn + "::" + t})
+	}
+	for _, t := range sp.Services {
+		ts = append(ts, target{nt: t, usn: udn + "::" + t})
+	}
+	return ts
+}
@@ -0,0 +1,39 @@
+// Copyright 2014 Mikio Hara. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+type description struct {
+	DeviceType   string `xml:"device>deviceType" json:"device-type,omitempty"`
+	FriendlyName string `xml:"device>friendlyName" json:"friendly-name,omitempty"`
+	Manufacturer string `xml:"device>manufacturer" json:"manufacturer,omitempty"`
+	ModelName    string `xml:"device>modelName" json:"model-name,omitempty"`
+	ModelNumber  string `xml:"device>modelNumber" json:"model-number,omitempty"`
+	UDN          string `xml:"device>UDN" json:"udn,omitempty"`
+}
+
+var client = http.Client{Timeout: 5 * time.Second}
+
+func fetchDescription(loc string) (*description, error) {
+	resp, err := client.Get(loc)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", loc, resp.Status)
+	}
+	var d description
+	if err := xml.NewDecoder(resp.Body).Decode(&d); err != nil {
+		return nil, fmt.Errorf("%s: %v", loc, err)
+	}
+	return &d, nil
+}
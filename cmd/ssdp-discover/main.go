@@ -0,0 +1,254 @@
+// Copyright 2014 Mikio Hara. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Ssdp-discover searches SSDP devices and services.
+//
+// Usage:
+//
+//	ssdp-discover [flags]
+//
+// It issues M-SEARCH messages for the search target on the specified
+// network interfaces and groups, and prints the responses as a
+// table, JSON or NDJSON. In watch mode it prints NOTIFY messages
+// instead until interrupted.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/mikioh/ssdp"
+)
+
+var (
+	st        = flag.String("st", "ssdp:all", "search target")
+	ifnames   = flag.String("i", "", "comma-separated list of network interfaces; all available multicast interfaces when empty")
+	groups    = flag.String("g", ssdp.DefaultIPv4Group, "comma-separated list of multicast groups")
+	localPort = flag.String("port", "", "local port; "+ssdp.DefaultPort+" when empty")
+	loopback  = flag.Bool("loopback", false, "loop back outgoing multicast messages to the local host")
+	mx        = flag.Int("mx", 3, "maximum wait time in seconds for responses")
+	format    = flag.String("o", "table", "output format: table, json or ndjson")
+	describe  = flag.Bool("describe", false, "fetch device descriptions")
+	watch     = flag.Bool("watch", false, "stream alive, byebye and update notifications instead of searching")
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s [flags]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	log.SetFlags(0)
+	log.SetPrefix("ssdp-discover: ")
+
+	switch *format {
+	case "table", "json", "ndjson":
+	default:
+		log.Fatalf("unknown output format: %s", *format)
+	}
+	mifs, err := interfaces(*ifnames)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var cps []*ssdp.ControlPoint
+	for _, grp := range strings.Split(*groups, ",") {
+		ln := ssdp.Listener{Group: strings.TrimSpace(grp), LocalPort: *localPort, MulticastLoopback: *loopback}
+		cp, err := ln.ListenControlPoint(mifs)
+		if err != nil {
+			log.Fatalf("%s: %v", grp, err)
+		}
+		defer cp.Close()
+		cps = append(cps, cp)
+	}
+	if *watch {
+		watchNotify(cps)
+		return
+	}
+	search(cps)
+}
+
+func interfaces(s string) ([]net.Interface, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var mifs []net.Interface
+	for _, name := range strings.Split(s, ",") {
+		ifi, err := net.InterfaceByName(strings.TrimSpace(name))
+		if err != nil {
+			return nil, err
+		}
+		mifs = append(mifs, *ifi)
+	}
+	return mifs, nil
+}
+
+type result struct {
+	Group        string       `json:"group"`
+	ST           string       `json:"st"`
+	USN          string       `json:"usn"`
+	Location     string       `json:"location"`
+	Server       string       `json:"server,omitempty"`
+	CacheControl string       `json:"cache-control,omitempty"`
+	Description  *description `json:"description,omitempty"`
+}
+
+func search(cps []*ssdp.ControlPoint) {
+	var (
+		wg sync.WaitGroup
+		mu sync.Mutex
+		rs []result
+	)
+	seen := make(map[string]bool)
+	for _, cp := range cps {
+		go cp.Serve(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+		wg.Add(1)
+		go func(cp *ssdp.ControlPoint) {
+			defer wg.Done()
+			hdr := make(http.Header)
+			hdr.Set("Man", `"ssdp:discover"`)
+			hdr.Set("Mx", strconv.Itoa(*mx))
+			hdr.Set("St", *st)
+			resps, err := cp.MSearch(hdr, cp.Interfaces(), time.Duration(*mx+1)*time.Second)
+			if err != nil {
+				log.Printf("%v: %v", cp.GroupAddr(), err)
+				return
+			}
+			for _, resp := range resps {
+				resp.Body.Close()
+				r := result{
+					Group:        cp.GroupAddr().IP.String(),
+					ST:           resp.Header.Get("St"),
+					USN:          resp.Header.Get("Usn"),
+					Location:     resp.Header.Get("Location"),
+					Server:       resp.Header.Get("Server"),
+					CacheControl: resp.Header.Get("Cache-Control"),
+				}
+				key := r.Group + " " + r.ST + " " + r.USN + " " + r.Location
+				mu.Lock()
+				if !seen[key] {
+					seen[key] = true
+					rs = append(rs, r)
+				}
+				mu.Unlock()
+			}
+		}(cp)
+	}
+	wg.Wait()
+	if *describe {
+		descs := make(map[string]*description)
+		for i := range rs {
+			if rs[i].Location == "" {
+				continue
+			}
+			d, ok := descs[rs[i].Location]
+			if !ok {
+				var err error
+				if d, err = fetchDescription(rs[i].Location); err != nil {
+					log.Print(err)
+				}
+				descs[rs[i].Location] = d
+			}
+			rs[i].Description = d
+		}
+	}
+	switch *format {
+	case "table":
+		printTable(os.Stdout, rs)
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "\t")
+		if rs == nil {
+			rs = []result{}
+		}
+		enc.Encode(rs)
+	case "ndjson":
+		enc := json.NewEncoder(os.Stdout)
+		for _, r := range rs {
+			enc.Encode(r)
+		}
+	}
+}
+
+func printTable(w io.Writer, rs []result) {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	if *describe {
+		fmt.Fprintln(tw, "GROUP\tST\tUSN\tLOCATION\tSERVER\tFRIENDLY NAME\tMODEL")
+	} else {
+		fmt.Fprintln(tw, "GROUP\tST\tUSN\tLOCATION\tSERVER")
+	}
+	for _, r := range rs {
+		if *describe {
+			var name, model string
+			if r.Description != nil {
+				name, model = r.Description.FriendlyName, r.Description.ModelName
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", r.Group, r.ST, r.USN, r.Location, r.Server, name, model)
+			continue
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", r.Group, r.ST, r.USN, r.Location, r.Server)
+	}
+	tw.Flush()
+}
+
+type notification struct {
+	Time     time.Time `json:"time"`
+	Group    string    `json:"group"`
+	NTS      string    `json:"nts"`
+	NT       string    `json:"nt"`
+	USN      string    `json:"usn"`
+	Location string    `json:"location,omitempty"`
+	Server   string    `json:"server,omitempty"`
+}
+
+func watchNotify(cps []*ssdp.ControlPoint) {
+	var mu sync.Mutex
+	enc := json.NewEncoder(os.Stdout)
+	if *format == "table" {
+		fmt.Printf("%-15s  %-15s  %-12s  %s\n", "TIME", "GROUP", "NTS", "NT / USN / LOCATION")
+	}
+	for _, cp := range cps {
+		grp := cp.GroupAddr().IP.String()
+		hdlr := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			n := notification{
+				Time:     time.Now(),
+				Group:    grp,
+				NTS:      req.Header.Get("Nts"),
+				NT:       req.Header.Get("Nt"),
+				USN:      req.Header.Get("Usn"),
+				Location: req.Header.Get("Location"),
+				Server:   req.Header.Get("Server"),
+			}
+			if *st != "ssdp:all" && n.NT != *st {
+				return
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if *format == "table" {
+				fmt.Printf("%-15s  %-15s  %-12s  %s %s %s\n", n.Time.Format(time.StampMilli), n.Group, n.NTS, n.NT, n.USN, n.Location)
+				return
+			}
+			enc.Encode(n)
+		})
+		go func(cp *ssdp.ControlPoint) {
+			if err := cp.Serve(hdlr); err != nil {
+				log.Print(err)
+			}
+		}(cp)
+	}
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt)
+	<-sig
+}
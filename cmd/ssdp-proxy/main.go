@@ -0,0 +1,197 @@
+// Copyright 2014 Mikio Hara. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Ssdp-proxy bridges SSDP messages between network interfaces.
+//
+// Usage:
+//
+//	ssdp-proxy [flags] -pair ifname,ifname [-pair ifname,ifname ...]
+//
+// It forwards NOTIFY and M-SEARCH messages received on one
+// interface of each pair to the other, and relays unicast responses
+// to forwarded searches back to the original requesters.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+
+	"github.com/mikioh/ssdp"
+)
+
+type pairs map[string][]string // inbound interface name to outbound interface names
+
+func (ps pairs) String() string {
+	var ss []string
+	for in, outs := range ps {
+		for _, out := range outs {
+			ss = append(ss, in+"->"+out)
+		}
+	}
+	return strings.Join(ss, " ")
+}
+
+func (ps pairs) Set(s string) error {
+	ss := strings.Split(s, ",")
+	if len(ss) != 2 || ss[0] == "" || ss[1] == "" || ss[0] == ss[1] {
+		return fmt.Errorf("malformed interface pair: %s", s)
+	}
+	ps[ss[0]] = append(ps[ss[0]], ss[1])
+	ps[ss[1]] = append(ps[ss[1]], ss[0])
+	return nil
+}
+
+type rewrites [][2]string // LOCATION prefix rewrite rules
+
+func (rws *rewrites) String() string {
+	var ss []string
+	for _, rw := range *rws {
+		ss = append(ss, rw[0]+"="+rw[1])
+	}
+	return strings.Join(ss, " ")
+}
+
+func (rws *rewrites) Set(s string) error {
+	i := strings.Index(s, "=")
+	if i <= 0 {
+		return fmt.Errorf("malformed location rewrite rule: %s", s)
+	}
+	*rws = append(*rws, [2]string{s[:i], s[i+1:]})
+	return nil
+}
+
+func (rws rewrites) rewrite(loc string) string {
+	for _, rw := range rws {
+		if strings.HasPrefix(loc, rw[0]) {
+			return rw[1] + loc[len(rw[0]):]
+		}
+	}
+	return loc
+}
+
+var (
+	ifPairs  = make(pairs)
+	locRules rewrites
+
+	group     = flag.String("g", ssdp.DefaultIPv4Group, "multicast group")
+	localPort = flag.String("port", "", "local port; "+ssdp.DefaultPort+" when empty")
+	verbose   = flag.Bool("v", false, "log forwarded messages")
+)
+
+func init() {
+	flag.Var(ifPairs, "pair", "comma-separated pair of network interfaces to bridge; may be repeated")
+	flag.Var(&locRules, "rewrite-location", "rewrite LOCATION prefix `old=new` on forwarded messages; may be repeated")
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s [flags] -pair ifname,ifname [-pair ifname,ifname ...]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	log.SetFlags(log.LstdFlags)
+	log.SetPrefix("ssdp-proxy: ")
+	if len(ifPairs) == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	var mifs []net.Interface
+	for name := range ifPairs {
+		ifi, err := net.InterfaceByName(name)
+		if err != nil {
+			log.Fatal(err)
+		}
+		mifs = append(mifs, *ifi)
+	}
+	ln := ssdp.Listener{Group: *group, LocalPort: *localPort}
+	rdr, err := ln.ListenRedirector(mifs)
+	if err != nil {
+		log.Fatal(err)
+	}
+	p, err := newProxy(rdr)
+	if err != nil {
+		rdr.Close()
+		log.Fatal(err)
+	}
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt)
+		<-sig
+		rdr.Close()
+	}()
+	for _, ifi := range rdr.Interfaces() {
+		log.Printf("%v on %s, forwarding to %s", rdr.GroupAddr(), ifi.Name, strings.Join(ifPairs[ifi.Name], ","))
+	}
+	if err := rdr.Serve(p); err != nil {
+		log.Print(err)
+	}
+}
+
+type proxy struct {
+	rdr    *ssdp.Redirector
+	routes map[int][]net.Interface // inbound interface index to outbound interfaces
+}
+
+func newProxy(rdr *ssdp.Redirector) (*proxy, error) {
+	p := &proxy{rdr: rdr, routes: make(map[int][]net.Interface)}
+	joined := make(map[string]net.Interface)
+	for _, ifi := range rdr.Interfaces() {
+		joined[ifi.Name] = ifi
+	}
+	for in, outs := range ifPairs {
+		ifi, ok := joined[in]
+		if !ok {
+			return nil, fmt.Errorf("%s: not joined", in)
+		}
+		for _, out := range outs {
+			ifo, ok := joined[out]
+			if !ok {
+				return nil, fmt.Errorf("%s: not joined", out)
+			}
+			p.routes[ifi.Index] = append(p.routes[ifi.Index], ifo)
+		}
+	}
+	return p, nil
+}
+
+// RedirectAdvert forwards NOTIFY and M-SEARCH messages to the paired
+// interfaces.
+func (p *proxy) RedirectAdvert(adv *ssdp.AdvertRedirector) {
+	src, ifi := adv.ReversePath()
+	if ifi == nil {
+		return
+	}
+	hdr := adv.Header()
+	if loc := hdr.Get("Location"); loc != "" {
+		hdr.Set("Location", locRules.rewrite(loc))
+	}
+	for _, ifo := range p.routes[ifi.Index] {
+		if _, err := adv.WriteTo(adv.ForwardPath(), &ifo); err != nil {
+			log.Printf("%s from %v on %s to %s: %v", adv.Method(), src, ifi.Name, ifo.Name, err)
+			continue
+		}
+		if *verbose {
+			log.Printf("%s from %v on %s to %s", adv.Method(), src, ifi.Name, ifo.Name)
+		}
+	}
+}
+
+// RedirectResponse rewrites responses to forwarded searches. The
+// redirector relays them to the original requesters.
+func (p *proxy) RedirectResponse(resp *ssdp.ResponseRedirector) {
+	hdr := resp.Header()
+	if loc := hdr.Get("Location"); loc != "" {
+		hdr.Set("Location", locRules.rewrite(loc))
+	}
+	if *verbose {
+		src, _ := resp.ReversePath()
+		log.Printf("response from %v for %s", src, hdr.Get("St"))
+	}
+}
@@ -0,0 +1,192 @@
+// Copyright 2014 Mikio Hara. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Ssdp-sniff monitors SSDP messages passively.
+//
+// Usage:
+//
+//	ssdp-sniff [flags]
+//
+// It joins the multicast groups on the specified network interfaces
+// and prints every NOTIFY, M-SEARCH and response message it
+// receives without replying. Malformed messages are highlighted
+// along with the parse errors. Unicast responses are seen only when
+// they are addressed to the local port.
+//
+// The capture file written with the -w flag is in the libpcap format
+// and contains the messages encapsulated in synthesized IP and UDP
+// headers, so that it can be read or replayed by packet capture
+// tools.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mikioh/ssdp"
+)
+
+var (
+	ifnames   = flag.String("i", "", "comma-separated list of network interfaces; all available multicast interfaces when empty")
+	groups    = flag.String("g", ssdp.DefaultIPv4Group, "comma-separated list of multicast groups")
+	localPort = flag.String("port", "", "local port; "+ssdp.DefaultPort+" when empty")
+	verbose   = flag.Bool("v", false, "print whole messages")
+	capture   = flag.String("w", "", "write messages to the capture `file`")
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s [flags]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	log.SetFlags(0)
+	log.SetPrefix("ssdp-sniff: ")
+
+	var mifs []net.Interface
+	if *ifnames != "" {
+		for _, name := range strings.Split(*ifnames, ",") {
+			ifi, err := net.InterfaceByName(strings.TrimSpace(name))
+			if err != nil {
+				log.Fatal(err)
+			}
+			mifs = append(mifs, *ifi)
+		}
+	}
+	s := &sniffer{color: isTerminal(os.Stdout)}
+	if *capture != "" {
+		f, err := os.Create(*capture)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		if s.pw, err = newPCAPWriter(f); err != nil {
+			log.Fatal(err)
+		}
+	}
+	// The redirector logs parse failures; the sniffer reports them
+	// by itself.
+	errLog := log.New(devNull{}, "", 0)
+	for _, grp := range strings.Split(*groups, ",") {
+		ln := ssdp.Listener{Group: strings.TrimSpace(grp), LocalPort: *localPort}
+		rdr, err := ln.ListenRedirector(mifs)
+		if err != nil {
+			log.Fatalf("%s: %v", grp, err)
+		}
+		rdr.ErrorLog = errLog
+		defer rdr.Close()
+		for _, ifi := range rdr.Interfaces() {
+			log.Printf("listening on %v on %s", rdr.GroupAddr(), ifi.Name)
+		}
+		go rdr.Serve(s)
+	}
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt)
+	<-sig
+}
+
+type devNull struct{}
+
+func (devNull) Write(b []byte) (int, error) { return len(b), nil }
+
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// A sniffer implements ssdp.RedirectHandler and ssdp.MalformedHandler
+// without redirecting any message.
+type sniffer struct {
+	mu    sync.Mutex
+	color bool
+	pw    *pcapWriter
+}
+
+func (s *sniffer) RedirectAdvert(adv *ssdp.AdvertRedirector) {
+	src, ifi := adv.ReversePath()
+	hdr := adv.Header()
+	var summary string
+	switch adv.Method() {
+	case "NOTIFY":
+		summary = fields(hdr, "Nts", "Nt", "Usn", "Location")
+	case "M-SEARCH":
+		summary = fields(hdr, "St", "Mx", "Man")
+	}
+	s.print(time.Now(), adv.Method(), src, adv.ForwardPath(), ifi, summary, adv.Raw(), nil)
+}
+
+func (s *sniffer) RedirectResponse(resp *ssdp.ResponseRedirector) {
+	src, ifi := resp.ReversePath()
+	s.print(time.Now(), "RESPONSE", src, resp.ForwardPath(), ifi, fields(resp.Header(), "St", "Usn", "Location"), resp.Raw(), nil)
+}
+
+func (s *sniffer) RedirectMalformed(msg *ssdp.MalformedMessage) {
+	s.print(time.Now(), "MALFORMED", msg.Src, msg.Dst, msg.Interface, "", msg.Data, msg.Err)
+}
+
+func (s *sniffer) print(t time.Time, kind string, src, dst *net.UDPAddr, ifi *net.Interface, summary string, raw []byte, err error) {
+	ifname := "?"
+	if ifi != nil {
+		ifname = ifi.Name
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err != nil && s.color {
+		fmt.Print("\x1b[1;31m")
+	}
+	fmt.Printf("%s %s %v > %v %s", t.Format("15:04:05.000000"), ifname, src, dst, kind)
+	if summary != "" {
+		fmt.Printf(" %s", summary)
+	}
+	if err != nil {
+		fmt.Printf(": %v", err)
+		if !*verbose {
+			fmt.Printf(" %s", strconv.Quote(firstLine(raw)))
+		}
+	}
+	if err != nil && s.color {
+		fmt.Print("\x1b[0m")
+	}
+	fmt.Println()
+	if *verbose {
+		for _, l := range strings.SplitAfter(string(raw), "\n") {
+			if l != "" {
+				q := strconv.Quote(l)
+				fmt.Printf("\t%s\n", q[1:len(q)-1])
+			}
+		}
+	}
+	if s.pw != nil {
+		if err := s.pw.writePacket(t, src, dst, raw); err != nil {
+			log.Printf("capture failed: %v", err)
+		}
+	}
+}
+
+func fields(hdr http.Header, keys ...string) string {
+	var ss []string
+	for _, k := range keys {
+		if v := hdr.Get(k); v != "" {
+			ss = append(ss, strings.ToUpper(k)+"="+v)
+		}
+	}
+	return strings.Join(ss, " ")
+}
+
+func firstLine(b []byte) string {
+	s := string(b)
+	if i := strings.IndexByte(s, '\n'); i >= 0 {
+		s = s[:i+1]
+	}
+	return s
+}
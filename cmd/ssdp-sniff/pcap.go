@@ -0,0 +1,114 @@
+// Copyright 2014 Mikio Hara. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const linkTypeRaw = 101 // raw IPv4 or IPv6 packets
+
+// A pcapWriter writes SSDP messages to a capture file in the libpcap
+// format, encapsulated in synthesized IP and UDP headers.
+type pcapWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func newPCAPWriter(w io.Writer) (*pcapWriter, error) {
+	var b [24]byte
+	binary.LittleEndian.PutUint32(b[0:4], 0xa1b2c3d4)
+	binary.LittleEndian.PutUint16(b[4:6], 2)
+	binary.LittleEndian.PutUint16(b[6:8], 4)
+	binary.LittleEndian.PutUint32(b[16:20], 65535)
+	binary.LittleEndian.PutUint32(b[20:24], linkTypeRaw)
+	if _, err := w.Write(b[:]); err != nil {
+		return nil, err
+	}
+	return &pcapWriter{w: w}, nil
+}
+
+func (pw *pcapWriter) writePacket(t time.Time, src, dst *net.UDPAddr, payload []byte) error {
+	var pkt []byte
+	if src.IP.To4() != nil && dst.IP.To4() != nil {
+		pkt = ipv4Packet(src, dst, payload)
+	} else {
+		pkt = ipv6Packet(src, dst, payload)
+	}
+	var h [16]byte
+	binary.LittleEndian.PutUint32(h[0:4], uint32(t.Unix()))
+	binary.LittleEndian.PutUint32(h[4:8], uint32(t.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(h[8:12], uint32(len(pkt)))
+	binary.LittleEndian.PutUint32(h[12:16], uint32(len(pkt)))
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+	if _, err := pw.w.Write(h[:]); err != nil {
+		return err
+	}
+	_, err := pw.w.Write(pkt)
+	return err
+}
+
+func udpHeader(b []byte, src, dst *net.UDPAddr, payload []byte) {
+	binary.BigEndian.PutUint16(b[0:2], uint16(src.Port))
+	binary.BigEndian.PutUint16(b[2:4], uint16(dst.Port))
+	binary.BigEndian.PutUint16(b[4:6], uint16(8+len(payload)))
+	copy(b[8:], payload)
+}
+
+func ipv4Packet(src, dst *net.UDPAddr, payload []byte) []byte {
+	b := make([]byte, 20+8+len(payload))
+	b[0] = 0x45
+	binary.BigEndian.PutUint16(b[2:4], uint16(len(b)))
+	b[8] = 1  // TTL
+	b[9] = 17 // UDP
+	copy(b[12:16], src.IP.To4())
+	copy(b[16:20], dst.IP.To4())
+	binary.BigEndian.PutUint16(b[10:12], ^checksum(0, b[:20]))
+	udpHeader(b[20:], src, dst, payload) // UDP checksum is optional over IPv4
+	return b
+}
+
+func ipv6Packet(src, dst *net.UDPAddr, payload []byte) []byte {
+	b := make([]byte, 40+8+len(payload))
+	b[0] = 0x60
+	binary.BigEndian.PutUint16(b[4:6], uint16(8+len(payload)))
+	b[6] = 17 // UDP
+	b[7] = 1  // hop limit
+	copy(b[8:24], src.IP.To16())
+	copy(b[24:40], dst.IP.To16())
+	udpHeader(b[40:], src, dst, payload)
+	var ph [8]byte // rest of pseudo header
+	binary.BigEndian.PutUint32(ph[0:4], uint32(8+len(payload)))
+	ph[7] = 17
+	s := checksum(0, b[8:40])
+	s = checksum(s, ph[:])
+	cs := ^checksum(s, b[40:])
+	if cs == 0 {
+		cs = 0xffff
+	}
+	binary.BigEndian.PutUint16(b[46:48], cs)
+	return b
+}
+
+// checksum returns the folded one's complement sum of b added to
+// the partial sum s.
+func checksum(s uint16, b []byte) uint16 {
+	sum := uint32(s)
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return uint16(sum)
+}
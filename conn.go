@@ -7,6 +7,7 @@ package ssdp
 import (
 	"errors"
 	"net"
+	"sync"
 
 	"golang.org/x/net/ipv4"
 	"golang.org/x/net/ipv6"
@@ -23,8 +24,60 @@ type conn interface {
 
 	setControlFlags() error
 	readFrom([]byte) (int, *path, error)
-	writeTo([]byte, *net.UDPAddr) (int, error)
-	writeToMulti([]byte, *net.UDPAddr, []net.Interface) (int, error)
+	readBatch([]inMessage) (int, error)
+	writeTo([]byte, *net.UDPAddr, *net.Interface) (int, error)
+	writeBatch([]outMessage) ([]writeResult, error)
+	writeToMulti([]byte, *net.UDPAddr, []net.Interface) ([]writeResult, error)
+}
+
+// readBatchSize is the maximum number of messages read at once.
+const readBatchSize = 16
+
+// An inMessage represents an inbound message read in a batch.
+type inMessage struct {
+	b    []byte // buffer
+	n    int    // number of bytes read
+	path *path
+}
+
+func newInMessages(size int) []inMessage {
+	ims := make([]inMessage, readBatchSize)
+	for i := range ims {
+		ims[i].b = make([]byte, size)
+	}
+	return ims
+}
+
+// An outMessage represents an outbound message written in a batch.
+type outMessage struct {
+	b   []byte
+	dst *net.UDPAddr
+	ifi *net.Interface // outbound multicast interface, may be nil
+}
+
+// scopedDst returns the destination address. A link-local multicast
+// address without zone is scoped to the outbound network interface.
+func (om *outMessage) scopedDst() *net.UDPAddr {
+	if om.ifi != nil && om.dst.IP.IsLinkLocalMulticast() && om.dst.Zone == "" {
+		return &net.UDPAddr{IP: om.dst.IP, Port: om.dst.Port, Zone: om.ifi.Name}
+	}
+	return om.dst
+}
+
+func (om *outMessage) result() writeResult {
+	var r writeResult
+	if om.ifi != nil {
+		r.ifi = *om.ifi
+	}
+	return r
+}
+
+// A writeResult represents a result of writing a message on a
+// multicast network interface.
+type writeResult struct {
+	ifi net.Interface
+	n   int
+	err error
 }
 
 // a path represents a reverse path.
@@ -36,6 +89,9 @@ type path struct {
 
 type udp4Conn struct {
 	*ipv4.PacketConn
+	mu  sync.Mutex // serializes multicast interface selection without pktinfo
+	rmu sync.Mutex
+	rms []ipv4.Message // scratch messages for readBatch
 }
 
 func (c *udp4Conn) setControlFlags() error {
@@ -50,33 +106,111 @@ func (c *udp4Conn) readFrom(b []byte) (int, *path, error) {
 	return n, &path{src: src.(*net.UDPAddr), dst: &net.UDPAddr{IP: cm.Dst}, ifIndex: cm.IfIndex}, err
 }
 
-func (c *udp4Conn) writeTo(b []byte, peer *net.UDPAddr) (int, error) {
+// readBatch reads as many messages as possible into ims with a
+// single system call where the platform supports it. It returns the
+// number of messages read.
+func (c *udp4Conn) readBatch(ims []inMessage) (int, error) {
+	if !batchIO {
+		n, path, err := c.readFrom(ims[0].b)
+		if err != nil {
+			return 0, err
+		}
+		ims[0].n, ims[0].path = n, path
+		return 1, nil
+	}
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+	if len(c.rms) < len(ims) {
+		c.rms = make([]ipv4.Message, len(ims))
+		for i := range c.rms {
+			c.rms[i].Buffers = make([][]byte, 1)
+			c.rms[i].OOB = ipv4.NewControlMessage(ipv4.FlagDst | ipv4.FlagInterface)
+		}
+	}
+	ms := c.rms[:len(ims)]
+	for i := range ms {
+		ms[i].Buffers[0] = ims[i].b
+		ms[i].OOB = ms[i].OOB[:cap(ms[i].OOB)]
+	}
+	n, err := c.ReadBatch(ms, 0)
+	if err != nil {
+		return 0, err
+	}
+	for i := 0; i < n; i++ {
+		var cm ipv4.ControlMessage
+		if err := cm.Parse(ms[i].OOB[:ms[i].NN]); err != nil {
+			return 0, err
+		}
+		ims[i].n = ms[i].N
+		ims[i].path = &path{src: ms[i].Addr.(*net.UDPAddr), dst: &net.UDPAddr{IP: cm.Dst}, ifIndex: cm.IfIndex}
+	}
+	return n, nil
+}
+
+// writeTo writes the message b to the peer. The outbound network
+// interface ifi is used for sending multicast messages and is
+// selected per packet where the platform supports it, so that
+// concurrent writes on different interfaces don't interfere with each
+// other. It uses the system assigned multicast network interface when
+// ifi is nil.
+func (c *udp4Conn) writeTo(b []byte, peer *net.UDPAddr, ifi *net.Interface) (int, error) {
 	if len(b) == 0 { // to prevent writing malformed packets on some platforms
 		return 0, nil
 	}
+	if ifi == nil || !peer.IP.IsMulticast() {
+		return c.WriteTo(b, nil, peer)
+	}
+	if pktinfoIPv4 {
+		return c.WriteTo(b, &ipv4.ControlMessage{IfIndex: ifi.Index}, peer)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.SetMulticastInterface(ifi); err != nil {
+		return 0, err
+	}
 	return c.WriteTo(b, nil, peer)
 }
 
-func (c *udp4Conn) writeToMulti(b []byte, grp *net.UDPAddr, mifs []net.Interface) (int, error) {
-	if len(b) == 0 { // to prevent writing malformed packets on some platforms
-		return 0, nil
+// writeBatch writes the messages oms with as few system calls as
+// possible where the platform supports it. It returns the results in
+// the order of oms.
+func (c *udp4Conn) writeBatch(oms []outMessage) ([]writeResult, error) {
+	rs := make([]writeResult, len(oms))
+	for i := range oms {
+		rs[i] = oms[i].result()
 	}
-	var n, oks int
-	var lastErr error
-	for _, ifi := range mifs {
-		c.SetMulticastInterface(&ifi)
-		nn, err := c.writeTo(b, grp)
-		if err != nil {
-			lastErr = err
+	if !batchIO || !pktinfoIPv4 {
+		for i, om := range oms {
+			rs[i].n, rs[i].err = c.writeTo(om.b, om.dst, om.ifi)
+		}
+		return rs, lastWriteError(rs)
+	}
+	ms := make([]ipv4.Message, 0, len(oms))
+	idx := make([]int, 0, len(oms))
+	for i, om := range oms {
+		if len(om.b) == 0 { // to prevent writing malformed packets on some platforms
 			continue
 		}
-		n = nn
-		oks++
+		m := ipv4.Message{Buffers: [][]byte{om.b}, Addr: om.dst}
+		if om.ifi != nil && om.dst.IP.IsMulticast() {
+			m.OOB = (&ipv4.ControlMessage{IfIndex: om.ifi.Index}).Marshal()
+		}
+		ms = append(ms, m)
+		idx = append(idx, i)
+	}
+	writeMessages(c.WriteBatch, ms, idx, rs)
+	return rs, lastWriteError(rs)
+}
+
+func (c *udp4Conn) writeToMulti(b []byte, grp *net.UDPAddr, mifs []net.Interface) ([]writeResult, error) {
+	if len(b) == 0 { // to prevent writing malformed packets on some platforms
+		return nil, nil
 	}
-	if oks == 0 {
-		return 0, lastErr
+	oms := make([]outMessage, len(mifs))
+	for i := range mifs {
+		oms[i] = outMessage{b: b, dst: grp, ifi: &mifs[i]}
 	}
-	return n, nil
+	return c.writeBatch(oms)
 }
 
 func newUDP4Conn(c *ipv4.PacketConn) *udp4Conn {
@@ -85,6 +219,9 @@ func newUDP4Conn(c *ipv4.PacketConn) *udp4Conn {
 
 type udp6Conn struct {
 	*ipv6.PacketConn
+	mu  sync.Mutex // serializes multicast interface selection without pktinfo
+	rmu sync.Mutex
+	rms []ipv6.Message // scratch messages for readBatch
 }
 
 func (c *udp6Conn) setControlFlags() error {
@@ -99,43 +236,138 @@ func (c *udp6Conn) readFrom(b []byte) (int, *path, error) {
 	return n, &path{src: src.(*net.UDPAddr), dst: &net.UDPAddr{IP: cm.Dst}, ifIndex: cm.IfIndex}, err
 }
 
-func (c *udp6Conn) writeTo(b []byte, peer *net.UDPAddr) (int, error) {
+func (c *udp6Conn) readBatch(ims []inMessage) (int, error) {
+	if !batchIO {
+		n, path, err := c.readFrom(ims[0].b)
+		if err != nil {
+			return 0, err
+		}
+		ims[0].n, ims[0].path = n, path
+		return 1, nil
+	}
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+	if len(c.rms) < len(ims) {
+		c.rms = make([]ipv6.Message, len(ims))
+		for i := range c.rms {
+			c.rms[i].Buffers = make([][]byte, 1)
+			c.rms[i].OOB = ipv6.NewControlMessage(ipv6.FlagDst | ipv6.FlagInterface)
+		}
+	}
+	ms := c.rms[:len(ims)]
+	for i := range ms {
+		ms[i].Buffers[0] = ims[i].b
+		ms[i].OOB = ms[i].OOB[:cap(ms[i].OOB)]
+	}
+	n, err := c.ReadBatch(ms, 0)
+	if err != nil {
+		return 0, err
+	}
+	for i := 0; i < n; i++ {
+		var cm ipv6.ControlMessage
+		if err := cm.Parse(ms[i].OOB[:ms[i].NN]); err != nil {
+			return 0, err
+		}
+		ims[i].n = ms[i].N
+		ims[i].path = &path{src: ms[i].Addr.(*net.UDPAddr), dst: &net.UDPAddr{IP: cm.Dst}, ifIndex: cm.IfIndex}
+	}
+	return n, nil
+}
+
+func (c *udp6Conn) writeTo(b []byte, peer *net.UDPAddr, ifi *net.Interface) (int, error) {
 	if len(b) == 0 { // to prevent writing malformed packets on some platforms
 		return 0, nil
 	}
+	if ifi == nil || !peer.IP.IsMulticast() {
+		return c.WriteTo(b, nil, peer)
+	}
+	if pktinfoIPv6 {
+		return c.WriteTo(b, &ipv6.ControlMessage{IfIndex: ifi.Index}, peer)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.SetMulticastInterface(ifi); err != nil {
+		return 0, err
+	}
 	return c.WriteTo(b, nil, peer)
 }
 
-func (c *udp6Conn) writeToMulti(b []byte, grp *net.UDPAddr, mifs []net.Interface) (int, error) {
-	if len(b) == 0 { // to prevent writing malformed packets on some platforms
-		return 0, nil
+func (c *udp6Conn) writeBatch(oms []outMessage) ([]writeResult, error) {
+	rs := make([]writeResult, len(oms))
+	for i := range oms {
+		rs[i] = oms[i].result()
 	}
-	var n, oks int
-	var lastErr error
-	wrgrp := *grp
-	for _, ifi := range mifs {
-		c.SetMulticastInterface(&ifi)
-		if ipv6LinkLocal(wrgrp.IP) {
-			wrgrp.Zone = ifi.Name
+	if !batchIO || !pktinfoIPv6 {
+		for i, om := range oms {
+			rs[i].n, rs[i].err = c.writeTo(om.b, om.scopedDst(), om.ifi)
 		}
-		nn, err := c.writeTo(b, &wrgrp)
-		if err != nil {
-			lastErr = err
+		return rs, lastWriteError(rs)
+	}
+	ms := make([]ipv6.Message, 0, len(oms))
+	idx := make([]int, 0, len(oms))
+	for i, om := range oms {
+		if len(om.b) == 0 { // to prevent writing malformed packets on some platforms
 			continue
 		}
-		n = nn
-		oks++
+		m := ipv6.Message{Buffers: [][]byte{om.b}, Addr: om.scopedDst()}
+		if om.ifi != nil && om.dst.IP.IsMulticast() {
+			m.OOB = (&ipv6.ControlMessage{IfIndex: om.ifi.Index}).Marshal()
+		}
+		ms = append(ms, m)
+		idx = append(idx, i)
 	}
-	if oks == 0 {
-		return 0, lastErr
+	writeMessages(c.WriteBatch, ms, idx, rs)
+	return rs, lastWriteError(rs)
+}
+
+func (c *udp6Conn) writeToMulti(b []byte, grp *net.UDPAddr, mifs []net.Interface) ([]writeResult, error) {
+	if len(b) == 0 { // to prevent writing malformed packets on some platforms
+		return nil, nil
 	}
-	return n, nil
+	oms := make([]outMessage, len(mifs))
+	for i := range mifs {
+		oms[i] = outMessage{b: b, dst: grp, ifi: &mifs[i]}
+	}
+	return c.writeBatch(oms)
 }
 
 func newUDP6Conn(c *ipv6.PacketConn) *udp6Conn {
 	return &udp6Conn{PacketConn: c}
 }
 
+// writeMessages writes the messages ms in batches and fills the
+// results rs of the corresponding indices idx. A message that fails
+// to be written is recorded with the error and skipped.
+func writeMessages(write func([]ipv4.Message, int) (int, error), ms []ipv4.Message, idx []int, rs []writeResult) {
+	for len(ms) > 0 {
+		n, err := write(ms, 0)
+		for i := 0; i < n; i++ {
+			rs[idx[i]].n = ms[i].N
+		}
+		if err == nil && n == 0 {
+			err = errors.New("no message written")
+		}
+		if err != nil && n < len(ms) {
+			rs[idx[n]].err = err
+			n++
+		}
+		ms, idx = ms[n:], idx[n:]
+	}
+}
+
+// lastWriteError returns the last error when writing failed on all
+// the network interfaces.
+func lastWriteError(rs []writeResult) error {
+	var lastErr error
+	for _, r := range rs {
+		if r.err == nil {
+			return nil
+		}
+		lastErr = r.err
+	}
+	return lastErr
+}
+
 func joinGroup(c conn, grp *net.UDPAddr, mifs []net.Interface, unicast func(net.IP) bool) ([]net.Interface, error) {
 	mifs, err := interfaces(mifs, unicast)
 	if err != nil {
@@ -0,0 +1,232 @@
+// Copyright 2014 Mikio Hara. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ssdp
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/ipv4"
+)
+
+func TestConcurrentWriteIsolation(t *testing.T) {
+	if !supportsIPv4 {
+		t.Skip("ipv4 is not supported")
+	}
+	cpln := Listener{Port: "1913", LocalPort: "1913"}
+	cp, err := cpln.ListenControlPoint(nil)
+	if err != nil {
+		t.Skip(err)
+	}
+	defer cp.Close()
+	type arrival struct{ want, got string }
+	ch := make(chan arrival, 64)
+	go cp.Serve(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var got string
+		if ifi := InterfaceFromContext(req.Context()); ifi != nil {
+			got = ifi.Name
+		}
+		select {
+		case ch <- arrival{want: req.Header.Get("X-Interface"), got: got}:
+		default:
+		}
+	}))
+
+	devln := Listener{Port: "1913", LocalPort: "1914", MulticastLoopback: true}
+	dev, err := devln.ListenDevice(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dev.Close()
+	if len(dev.Interfaces()) == 0 {
+		t.Skip("no available multicast network interface found")
+	}
+	grp := &net.UDPAddr{IP: dev.GroupAddr().IP, Port: 1913}
+
+	var wg sync.WaitGroup
+	const N = 4
+	for i := 0; i < N; i++ {
+		for _, ifi := range dev.Interfaces() {
+			ifi := ifi
+			hdr := make(http.Header)
+			hdr.Set("Nt", "upnp:rootdevice")
+			hdr.Set("Nts", "ssdp:alive")
+			hdr.Set("Usn", fmt.Sprintf("uuid:%d::upnp:rootdevice", i))
+			hdr.Set("X-Interface", ifi.Name)
+			wg.Add(2)
+			go func() {
+				defer wg.Done()
+				if err := dev.Notify(hdr, []net.Interface{ifi}); err != nil {
+					t.Error(err)
+				}
+			}()
+			p := &path{src: &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1900}, dst: &net.UDPAddr{IP: grp.IP}, ifIndex: ifi.Index}
+			adv := newAdvertRedirector(dev.conn, dev.mifs, grp, p, newAdvert(notifyMethod, grp.String(), hdr.Clone()))
+			go func() {
+				defer wg.Done()
+				if _, err := adv.WriteTo(grp, &ifi); err != nil {
+					t.Error(err)
+				}
+			}()
+		}
+	}
+	wg.Wait()
+
+	n := 0
+	for {
+		select {
+		case a := <-ch:
+			n++
+			if a.got != a.want {
+				t.Errorf("message sent on %s received on %s", a.want, a.got)
+			}
+		case <-time.After(time.Second):
+			if n == 0 {
+				t.Fatal("no message received")
+			}
+			return
+		}
+	}
+}
+
+func newLoopbackUDP4Conn(tb testing.TB) (*udp4Conn, *net.UDPAddr) {
+	if !supportsIPv4 {
+		tb.Skip("ipv4 is not supported")
+	}
+	c, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	p := newUDP4Conn(ipv4.NewPacketConn(c))
+	if err := p.setControlFlags(); err != nil {
+		c.Close()
+		tb.Skip(err)
+	}
+	return p, c.LocalAddr().(*net.UDPAddr)
+}
+
+func TestBatchIO(t *testing.T) {
+	c, dst := newLoopbackUDP4Conn(t)
+	defer c.Close()
+
+	const N = readBatchSize + 3
+	oms := make([]outMessage, N)
+	for i := range oms {
+		oms[i] = outMessage{b: []byte(fmt.Sprintf("message %d", i)), dst: dst}
+	}
+	oms[1].b = nil
+	rs, err := c.writeBatch(oms)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, r := range rs {
+		if r.err != nil || r.n != len(oms[i].b) {
+			t.Errorf("#%d: got %d, %v; want %d, nil", i, r.n, r.err, len(oms[i].b))
+		}
+	}
+
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	ims := newInMessages(1280)
+	var got []string
+	for len(got) < N-1 {
+		n, err := c.readBatch(ims)
+		if err != nil {
+			t.Fatalf("got %d messages: %v", len(got), err)
+		}
+		for _, im := range ims[:n] {
+			if !im.path.dst.IP.Equal(dst.IP) || im.path.src.Port != dst.Port {
+				t.Errorf("unexpected path: %v -> %v", im.path.src, im.path.dst)
+			}
+			got = append(got, string(im.b[:im.n]))
+		}
+	}
+	for i, j := 0, 0; i < N; i++ {
+		if i == 1 {
+			continue
+		}
+		if want := string(oms[i].b); got[j] != want {
+			t.Errorf("got %q; want %q", got[j], want)
+		}
+		j++
+	}
+}
+
+func benchmarkMessages(dst *net.UDPAddr) []outMessage {
+	oms := make([]outMessage, readBatchSize)
+	for i := range oms {
+		oms[i] = outMessage{b: []byte("NOTIFY * HTTP/1.1\r\nHOST: 239.255.255.250:1900\r\nNT: upnp:rootdevice\r\nNTS: ssdp:alive\r\n\r\n"), dst: dst}
+	}
+	return oms
+}
+
+func BenchmarkWrite(b *testing.B) {
+	c, dst := newLoopbackUDP4Conn(b)
+	defer c.Close()
+	oms := benchmarkMessages(dst)
+	go func() {
+		ims := newInMessages(1280)
+		for {
+			if _, err := c.readBatch(ims); err != nil {
+				return
+			}
+		}
+	}()
+
+	b.Run("PerPacket", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			for _, om := range oms {
+				if _, err := c.writeTo(om.b, om.dst, nil); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+	b.Run("Batch", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := c.writeBatch(oms); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkRead(b *testing.B) {
+	c, dst := newLoopbackUDP4Conn(b)
+	defer c.Close()
+	oms := benchmarkMessages(dst)
+
+	b.Run("PerPacket", func(b *testing.B) {
+		buf := make([]byte, 1280)
+		for i := 0; i < b.N; i++ {
+			if _, err := c.writeBatch(oms); err != nil {
+				b.Fatal(err)
+			}
+			for range oms {
+				if _, _, err := c.readFrom(buf); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+	b.Run("Batch", func(b *testing.B) {
+		ims := newInMessages(1280)
+		for i := 0; i < b.N; i++ {
+			if _, err := c.writeBatch(oms); err != nil {
+				b.Fatal(err)
+			}
+			for n := 0; n < len(oms); {
+				k, err := c.readBatch(ims)
+				if err != nil {
+					b.Fatal(err)
+				}
+				n += k
+			}
+		}
+	})
+}
@@ -0,0 +1,98 @@
+// Copyright 2014 Mikio Hara. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ssdp
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"time"
+)
+
+type inboundKey struct{}
+
+// An inbound represents metadata of an inbound SSDP message.
+type inbound struct {
+	raw  []byte    // received message
+	at   time.Time // receive time
+	path *path     // reverse path
+	grp  *net.UDPAddr
+	mifs []net.Interface
+}
+
+// withInbound returns a shallow copy of req with the metadata of the
+// inbound message. The remote address of the copy is set to the
+// source address of the message.
+func withInbound(req *http.Request, in *inbound) *http.Request {
+	req = req.WithContext(context.WithValue(req.Context(), inboundKey{}, in))
+	req.RemoteAddr = in.path.src.String()
+	return req
+}
+
+func inboundFromContext(ctx context.Context) *inbound {
+	in, _ := ctx.Value(inboundKey{}).(*inbound)
+	return in
+}
+
+// RawMessageFromContext returns the inbound SSDP message as received
+// from the request context ctx of handlers. It returns nil when ctx
+// carries no inbound message. Callers must not modify the returned
+// slice.
+func RawMessageFromContext(ctx context.Context) []byte {
+	if in := inboundFromContext(ctx); in != nil {
+		return in.raw
+	}
+	return nil
+}
+
+// ReceivedTimeFromContext returns the time when the inbound SSDP
+// message of the request context ctx was received. It returns the
+// zero time when ctx carries no inbound message.
+func ReceivedTimeFromContext(ctx context.Context) time.Time {
+	if in := inboundFromContext(ctx); in != nil {
+		return in.at
+	}
+	return time.Time{}
+}
+
+// InterfaceFromContext returns the inbound network interface of the
+// SSDP message of the request context ctx. It returns nil when the
+// interface is unknown.
+func InterfaceFromContext(ctx context.Context) *net.Interface {
+	if in := inboundFromContext(ctx); in != nil {
+		return interfaceByIndex(in.mifs, in.path.ifIndex)
+	}
+	return nil
+}
+
+// DestinationAddrFromContext returns the destination address of the
+// inbound SSDP message of the request context ctx. It returns nil
+// when ctx carries no inbound message.
+func DestinationAddrFromContext(ctx context.Context) *net.UDPAddr {
+	if in := inboundFromContext(ctx); in != nil {
+		return in.path.dst
+	}
+	return nil
+}
+
+// SourceAddrFromContext returns the source address of the inbound
+// SSDP message of the request context ctx. It returns nil when ctx
+// carries no inbound message.
+func SourceAddrFromContext(ctx context.Context) *net.UDPAddr {
+	if in := inboundFromContext(ctx); in != nil {
+		return in.path.src
+	}
+	return nil
+}
+
+// GroupAddrFromContext returns the group address joined by the
+// endpoint that received the inbound SSDP message of the request
+// context ctx. It returns nil when ctx carries no inbound message.
+func GroupAddrFromContext(ctx context.Context) *net.UDPAddr {
+	if in := inboundFromContext(ctx); in != nil {
+		return in.grp
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+// Copyright 2014 Mikio Hara. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ssdp
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestInboundContext(t *testing.T) {
+	ctx := context.Background()
+	if b := RawMessageFromContext(ctx); b != nil {
+		t.Errorf("got %q; want nil", b)
+	}
+	if at := ReceivedTimeFromContext(ctx); !at.IsZero() {
+		t.Errorf("got %v; want zero time", at)
+	}
+	if ifi := InterfaceFromContext(ctx); ifi != nil {
+		t.Errorf("got %v; want nil", ifi)
+	}
+	if dst := DestinationAddrFromContext(ctx); dst != nil {
+		t.Errorf("got %v; want nil", dst)
+	}
+	if src := SourceAddrFromContext(ctx); src != nil {
+		t.Errorf("got %v; want nil", src)
+	}
+	if grp := GroupAddrFromContext(ctx); grp != nil {
+		t.Errorf("got %v; want nil", grp)
+	}
+
+	raw := []byte("M-SEARCH * HTTP/1.1\r\nhost: 239.255.255.250:1900\r\nMAN: \"ssdp:discover\"\r\n\r\n")
+	req, err := parseAdvert(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := time.Now()
+	ifi := net.Interface{Index: 3, Name: "test0"}
+	p := &path{src: &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 50000}, dst: &net.UDPAddr{IP: net.ParseIP(DefaultIPv4Group), Port: 1900}, ifIndex: ifi.Index}
+	grp := &net.UDPAddr{IP: net.ParseIP(DefaultIPv4Group), Port: 1900}
+	req = withInbound(req, &inbound{raw: raw, at: at, path: p, grp: grp, mifs: []net.Interface{ifi}})
+	ctx = req.Context()
+	if b := RawMessageFromContext(ctx); !bytes.Equal(b, raw) {
+		t.Errorf("got %q; want %q", b, raw)
+	}
+	if got := ReceivedTimeFromContext(ctx); !got.Equal(at) {
+		t.Errorf("got %v; want %v", got, at)
+	}
+	if got := InterfaceFromContext(ctx); got == nil || got.Name != ifi.Name {
+		t.Errorf("got %v; want %v", got, ifi)
+	}
+	if got := DestinationAddrFromContext(ctx); got != p.dst {
+		t.Errorf("got %v; want %v", got, p.dst)
+	}
+	if got := SourceAddrFromContext(ctx); got != p.src {
+		t.Errorf("got %v; want %v", got, p.src)
+	}
+	if got := GroupAddrFromContext(ctx); got != grp {
+		t.Errorf("got %v; want %v", got, grp)
+	}
+	if req.RemoteAddr != "192.0.2.1:50000" {
+		t.Errorf("got %q; want 192.0.2.1:50000", req.RemoteAddr)
+	}
+	if req.Method != msearchMethod || req.Header.Get("Man") == "" {
+		t.Errorf("got %v, %v; want the parsed request", req.Method, req.Header)
+	}
+}
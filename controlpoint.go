@@ -7,7 +7,9 @@ package ssdp
 import (
 	"bytes"
 	"errors"
+	"fmt"
 	"log"
+	"log/slog"
 	"net"
 	"net/http"
 	"runtime"
@@ -22,10 +24,23 @@ type ControlPoint struct {
 	// standard logger.
 	ErrorLog *log.Logger
 
+	// Logger optionally specifies a structured logger. If it is
+	// not nil, it is used instead of ErrorLog. Messages to unknown
+	// destinations are logged at slog.LevelDebug.
+	Logger *slog.Logger
+
+	// StrictSend specifies whether sending a message fails when
+	// it fails on any of the multicast network interfaces. The
+	// error is a *SendError. Otherwise sending fails only when it
+	// fails on all the interfaces.
+	StrictSend bool
+
 	conn                      // network connection endpoint
 	group   *net.UDPAddr      // group address
 	unicast func(net.IP) bool // unicast address filter
 	mifs    []net.Interface   // multicast network interfaces
+	mode    ParseMode         // parsing strictness
+	stats   *endpointStats
 
 	muxmu sync.RWMutex
 	mux   map[*http.Request]chan *http.Response // unicast message mux
@@ -36,10 +51,11 @@ type ControlPoint struct {
 // tries to listen on all available multicast network interfaces.
 func (ln *Listener) ListenControlPoint(mifs []net.Interface) (*ControlPoint, error) {
 	var err error
-	cp := &ControlPoint{mux: make(map[*http.Request]chan *http.Response)}
+	cp := &ControlPoint{mux: make(map[*http.Request]chan *http.Response), stats: newEndpointStats()}
 	if cp.conn, cp.group, err = ln.listen(); err != nil {
 		return nil, err
 	}
+	cp.mode = ln.ParseMode
 	if cp.group.IP.To4() != nil {
 		cp.unicast = ipv4Unicast
 	} else {
@@ -53,59 +69,97 @@ func (ln *Listener) ListenControlPoint(mifs []net.Interface) (*ControlPoint, err
 }
 
 // Serve starts to handle incoming SSDP messages from SSDP
-// devices. The handler must not be nil.
+// devices. The handler must not be nil. Only NOTIFY messages are
+// converted to http.Request and passed to the handler, and response
+// messages are converted to http.Response only while searches are in
+// progress; the others are parsed and counted without allocation.
 func (cp *ControlPoint) Serve(hdlr http.Handler) error {
 	if hdlr == nil {
 		return errors.New("invalid http handler")
 	}
-	b := make([]byte, 1280)
+	ims := newInMessages(1280)
+	var m message
 	for {
-		n, path, err := cp.readFrom(b)
+		k, err := cp.readBatch(ims)
 		if err != nil {
 			if nerr, ok := err.(net.Error); ok && nerr.Temporary() {
-				cp.logf("read failed: %v", err)
+				cp.logEvent(logRecord{level: slog.LevelWarn, kind: LogKindRead, msg: "read failed", err: err})
 				continue
 			}
 			return err
 		}
-		if !path.dst.IP.IsMulticast() {
-			resp, err := parseResponse(b[:n])
-			if err != nil {
-				cp.logf("parse response failed: %v", err)
-				continue
-			}
-			cp.muxmu.RLock()
-			for _, ch := range cp.mux {
-				ch <- resp
-			}
-			cp.muxmu.RUnlock()
-			continue
+		at := time.Now()
+		for i := range ims[:k] {
+			cp.serveMessage(hdlr, &m, ims[i].b[:ims[i].n], ims[i].path, at)
 		}
-		if !path.dst.IP.Equal(cp.group.IP) {
-			cp.logf("unknown destination address: %v on %v", path.dst, interfaceByIndex(cp.mifs, path.ifIndex).Name)
-			continue
+	}
+}
+
+// serveMessage handles the inbound SSDP message b received at the
+// time at. The message m is used for parsing b.
+func (cp *ControlPoint) serveMessage(hdlr http.Handler, m *message, b []byte, path *path, at time.Time) {
+	if !path.dst.IP.IsMulticast() {
+		devs, err := m.parseMode(b, true, cp.mode)
+		if err != nil {
+			cp.stats.parseFailed()
+			cp.logEvent(logRecord{level: slog.LevelWarn, kind: LogKindParse, msg: "parse response failed", path: path, mifs: cp.mifs, err: err})
+			return
 		}
-		req, err := parseAdvert(b[:n])
+		cp.stats.received(MethodResponse, "")
+		cp.muxmu.RLock()
+		defer cp.muxmu.RUnlock()
+		if len(cp.mux) == 0 {
+			return
+		}
+		resp, err := m.response()
 		if err != nil {
-			cp.logf("parse advert failed: %v", err)
-			continue
+			return
 		}
-		if req.Method != notifyMethod {
-			continue
+		for req, ch := range cp.mux {
+			resp := *resp
+			resp.Request = req
+			withResponseDeviations(&resp, devs)
+			ch <- &resp
 		}
-		resp := newResponseWriter(cp.conn, cp.mifs, cp.group, path, req)
-		go func() {
-			defer func() {
-				if err := recover(); err != nil {
-					const size = 64 << 10
-					b := make([]byte, size)
-					b = b[:runtime.Stack(b, false)]
-					cp.logf("panic serving %v: %v\n%s", resp.path.src, err, b)
-				}
-			}()
-			hdlr.ServeHTTP(resp, req)
-		}()
+		return
+	}
+	if !path.dst.IP.Equal(cp.group.IP) {
+		cp.stats.unknownDestination()
+		cp.logEvent(logRecord{level: slog.LevelDebug, kind: LogKindUnknownDestination, msg: "unknown destination address", path: path, mifs: cp.mifs})
+		return
+	}
+	devs, err := m.parseMode(b, false, cp.mode)
+	if err != nil {
+		cp.stats.parseFailed()
+		cp.logEvent(logRecord{level: slog.LevelWarn, kind: LogKindParse, msg: "parse advert failed", path: path, mifs: cp.mifs, err: err})
+		return
+	}
+	cp.stats.received(m.methodName(), m.nts())
+	if string(m.method) != notifyMethod {
+		return
+	}
+	req, err := m.request()
+	if err != nil {
+		return
 	}
+	req = withDeviations(req, devs)
+	resp := newResponseWriter(cp.conn, cp.mifs, cp.group, path, req)
+	req = withInbound(req, &inbound{raw: append([]byte(nil), b...), at: at, path: path, grp: cp.group, mifs: cp.mifs})
+	go func() {
+		defer func() {
+			if err := recover(); err != nil {
+				cp.stats.panicked()
+				const size = 64 << 10
+				b := make([]byte, size)
+				b = b[:runtime.Stack(b, false)]
+				cp.logEvent(logRecord{level: slog.LevelError, kind: LogKindPanic, msg: "panic serving", path: resp.path, mifs: cp.mifs, method: req.Method, hdr: req.Header, err: fmt.Errorf("%v", err), stack: b})
+			}
+		}()
+		hdlr.ServeHTTP(resp, req)
+		if err := resp.finish(); err != nil {
+			cp.logEvent(logRecord{level: slog.LevelWarn, kind: LogKindWrite, msg: "write response failed", path: resp.path, mifs: cp.mifs, method: MethodResponse, err: err})
+		}
+	}()
 }
 
 // GroupAddr returns the joined group network address.
@@ -130,23 +184,51 @@ func (cp *ControlPoint) Interfaces() []net.Interface {
 // MSearch issues a M-SEARCH SSDP message, takes a timeout and returns
 // a list of responses. Callers should close each http.Response.Body
 // when done reading from it. If mifs is nil, it tries to use all
-// available multicast network interfaces.
+// available multicast network interfaces. The Request field of each
+// response holds the issued request.
 func (cp *ControlPoint) MSearch(hdr http.Header, mifs []net.Interface, tmo time.Duration) ([]*http.Response, error) {
-	req := newAdvert(msearchMethod, cp.group.String(), hdr)
+	resps, _, err := cp.MSearchResults(Search{Header: HeaderFromHTTP(hdr), Interfaces: mifs, Timeout: tmo})
+	return resps, err
+}
+
+// A Search represents a M-SEARCH message to be issued.
+type Search struct {
+	// Header is the header, written on the wire as is. HOST field
+	// is added when Header has none.
+	Header Header
+
+	// Interfaces specifies the outbound multicast network
+	// interfaces. If it is nil, all available multicast network
+	// interfaces are used.
+	Interfaces []net.Interface
+
+	// Timeout specifies how long to wait for responses.
+	Timeout time.Duration
+}
+
+// MSearchResults is like MSearch but issues the M-SEARCH message s
+// and also returns the results on the attempted multicast network
+// interfaces.
+func (cp *ControlPoint) MSearchResults(s Search) ([]*http.Response, []SendResult, error) {
+	req := newAdvert(msearchMethod, cp.group.String(), s.Header.HTTPHeader())
 	var buf bytes.Buffer
-	if err := marshalAdvert(&buf, req); err != nil {
-		return nil, err
+	if err := marshalHeaderAdvert(&buf, msearchMethod, cp.group.String(), s.Header); err != nil {
+		return nil, nil, err
 	}
-	mifs, err := interfaces(mifs, cp.unicast)
+	mifs, err := interfaces(s.Interfaces, cp.unicast)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	if _, err := cp.writeToMulti(buf.Bytes(), cp.group, mifs); err != nil {
-		return nil, err
+	rs, err := cp.writeToMulti(buf.Bytes(), cp.group, mifs)
+	cp.stats.wrote(msearchMethod, "", rs)
+	srs := sendResults(rs)
+	if err := sendError(srs, cp.StrictSend, err); err != nil {
+		return nil, srs, err
 	}
+	sent := time.Now()
 	respCh := cp.register(req)
 	defer cp.deregister(req)
-	t := time.NewTimer(tmo)
+	t := time.NewTimer(s.Timeout)
 	defer t.Stop()
 	var resps []*http.Response
 loop:
@@ -155,10 +237,16 @@ loop:
 		case <-t.C:
 			break loop
 		case resp := <-respCh:
+			cp.stats.searchLatency(time.Since(sent))
 			resps = append(resps, resp)
 		}
 	}
-	return resps, nil
+	return resps, srs, nil
+}
+
+// Stats returns a snapshot of the statistics of the control point.
+func (cp *ControlPoint) Stats() Stats {
+	return cp.stats.snapshot()
 }
 
 func (cp *ControlPoint) register(req *http.Request) chan *http.Response {
@@ -181,10 +269,6 @@ func (cp *ControlPoint) deregister(req *http.Request) {
 	cp.muxmu.Unlock()
 }
 
-func (cp *ControlPoint) logf(format string, args ...interface{}) {
-	if cp.ErrorLog != nil {
-		cp.ErrorLog.Printf(format, args...)
-	} else {
-		log.Printf(format, args...)
-	}
+func (cp *ControlPoint) logEvent(r logRecord) {
+	writeLog(cp.Logger, cp.ErrorLog, &r)
 }
@@ -7,10 +7,14 @@ package ssdp
 import (
 	"bytes"
 	"errors"
+	"fmt"
 	"log"
+	"log/slog"
 	"net"
 	"net/http"
 	"runtime"
+	"strconv"
+	"time"
 )
 
 // A Device represents a SSDP device.
@@ -20,10 +24,28 @@ type Device struct {
 	// standard logger.
 	ErrorLog *log.Logger
 
+	// Logger optionally specifies a structured logger. If it is
+	// not nil, it is used instead of ErrorLog. Messages to unknown
+	// destinations are logged at slog.LevelDebug.
+	Logger *slog.Logger
+
+	// MaxResponseSize specifies the maximum size of response
+	// messages written by the handler. If it is zero,
+	// DefaultMaxResponseSize will be used.
+	MaxResponseSize int
+
+	// StrictSend specifies whether sending a message fails when
+	// it fails on any of the multicast network interfaces. The
+	// error is a *SendError. Otherwise sending fails only when it
+	// fails on all the interfaces.
+	StrictSend bool
+
 	conn                      // network connection endpoint
 	group   *net.UDPAddr      // group address
 	unicast func(net.IP) bool // unicast address filter
 	mifs    []net.Interface   // multicast network interfaces
+	mode    ParseMode         // parsing strictness
+	stats   *endpointStats
 }
 
 // ListenDevices listens on the UDP network Listener.Group and
@@ -31,10 +53,11 @@ type Device struct {
 // listen on all available multicast network interfaces.
 func (ln *Listener) ListenDevice(mifs []net.Interface) (*Device, error) {
 	var err error
-	dev := &Device{}
+	dev := &Device{stats: newEndpointStats()}
 	if dev.conn, dev.group, err = ln.listen(); err != nil {
 		return nil, err
 	}
+	dev.mode = ln.ParseMode
 	if dev.group.IP.To4() != nil {
 		dev.unicast = ipv4Unicast
 	} else {
@@ -48,51 +71,78 @@ func (ln *Listener) ListenDevice(mifs []net.Interface) (*Device, error) {
 }
 
 // Serve starts to handle incoming SSDP messages from SSDP control
-// points. The handler must not be nil.
+// points. The handler must not be nil. Only M-SEARCH messages are
+// converted to http.Request and passed to the handler; the others are
+// parsed and counted without allocation.
 func (dev *Device) Serve(hdlr http.Handler) error {
 	if hdlr == nil {
 		return errors.New("invalid http handler")
 	}
-	b := make([]byte, 1280)
+	ims := newInMessages(1280)
+	var m message
 	for {
-		n, path, err := dev.readFrom(b)
+		k, err := dev.readBatch(ims)
 		if err != nil {
 			if nerr, ok := err.(net.Error); ok && nerr.Temporary() {
-				dev.logf("read failed: %v", err)
+				dev.logEvent(logRecord{level: slog.LevelWarn, kind: LogKindRead, msg: "read failed", err: err})
 				continue
 			}
 			return err
 		}
-		if !path.dst.IP.IsMulticast() {
-			continue
-		}
-		if !path.dst.IP.Equal(dev.group.IP) {
-			dev.logf("unknown destination address: %v on %v", path.dst, interfaceByIndex(dev.mifs, path.ifIndex).Name)
-			continue
-		}
-		req, err := parseAdvert(b[:n])
-		if err != nil {
-			dev.logf("parse advert failed: %v", err)
-			continue
-		}
-		if req.Method != msearchMethod {
-			continue
+		at := time.Now()
+		for i := range ims[:k] {
+			dev.serveMessage(hdlr, &m, ims[i].b[:ims[i].n], ims[i].path, at)
 		}
-		resp := newResponseWriter(dev.conn, dev.mifs, dev.group, path, req)
-		go func() {
-			defer func() {
-				if err := recover(); err != nil {
-					const size = 64 << 10
-					b := make([]byte, size)
-					b = b[:runtime.Stack(b, false)]
-					dev.logf("panic serving %v: %v\n%s", resp.path.src, err, b)
-				}
-			}()
-			hdlr.ServeHTTP(resp, req)
-		}()
 	}
 }
 
+// serveMessage handles the inbound SSDP message b received at the
+// time at. The message m is used for parsing b.
+func (dev *Device) serveMessage(hdlr http.Handler, m *message, b []byte, path *path, at time.Time) {
+	if !path.dst.IP.IsMulticast() {
+		return
+	}
+	if !path.dst.IP.Equal(dev.group.IP) {
+		dev.stats.unknownDestination()
+		dev.logEvent(logRecord{level: slog.LevelDebug, kind: LogKindUnknownDestination, msg: "unknown destination address", path: path, mifs: dev.mifs})
+		return
+	}
+	devs, err := m.parseMode(b, false, dev.mode)
+	if err != nil {
+		dev.stats.parseFailed()
+		dev.logEvent(logRecord{level: slog.LevelWarn, kind: LogKindParse, msg: "parse advert failed", path: path, mifs: dev.mifs, err: err})
+		return
+	}
+	dev.stats.received(m.methodName(), m.nts())
+	if string(m.method) != msearchMethod {
+		return
+	}
+	req, err := m.request()
+	if err != nil {
+		return
+	}
+	req = withDeviations(req, devs)
+	resp := newResponseWriter(dev.conn, dev.mifs, dev.group, path, req)
+	req = withInbound(req, &inbound{raw: append([]byte(nil), b...), at: at, path: path, grp: dev.group, mifs: dev.mifs})
+	resp.stats = dev.stats
+	resp.max = dev.MaxResponseSize
+	go func() {
+		defer func() {
+			if err := recover(); err != nil {
+				dev.stats.panicked()
+				const size = 64 << 10
+				b := make([]byte, size)
+				b = b[:runtime.Stack(b, false)]
+				dev.logEvent(logRecord{level: slog.LevelError, kind: LogKindPanic, msg: "panic serving", path: resp.path, mifs: dev.mifs, method: req.Method, hdr: req.Header, err: fmt.Errorf("%v", err), stack: b})
+			}
+		}()
+		hdlr.ServeHTTP(resp, req)
+		if err := resp.finish(); err != nil {
+			dev.logEvent(logRecord{level: slog.LevelWarn, kind: LogKindWrite, msg: "write response failed", path: resp.path, mifs: dev.mifs, method: MethodResponse, err: err})
+		}
+	}()
+}
+
 // GroupAddr returns the joined group network address.
 func (dev *Device) GroupAddr() *net.UDPAddr {
 	return dev.group
@@ -113,27 +163,161 @@ func (dev *Device) Interfaces() []net.Interface {
 }
 
 // Notify issues a NOTIFY SSDP message. If mifs is nil, it tries to
-// use all available multicast network interfaces.
+// use all available multicast network interfaces. It is a shorthand
+// for PrepareNotify followed by NotifyPrepared.
 func (dev *Device) Notify(hdr http.Header, mifs []net.Interface) error {
-	req := newAdvert(notifyMethod, dev.group.String(), hdr)
-	var buf bytes.Buffer
-	if err := req.Write(&buf); err != nil {
+	pm, err := dev.PrepareNotify(Notification{Header: HeaderFromHTTP(hdr), Interfaces: mifs})
+	if err != nil {
 		return err
 	}
-	mifs, err := interfaces(mifs, dev.unicast)
+	_, err = dev.NotifyPrepared(pm)
+	return err
+}
+
+// A Notification represents a NOTIFY message to be prepared for
+// sending.
+type Notification struct {
+	// Header is the header, written on the wire as is. HOST field
+	// is added when Header has none.
+	Header Header
+
+	// Body optionally specifies the message body. CONTENT-LENGTH
+	// field is added when Header has none.
+	Body []byte
+
+	// Interfaces specifies the outbound multicast network
+	// interfaces. If it is nil, all available multicast network
+	// interfaces are used.
+	Interfaces []net.Interface
+
+	// Location optionally specifies a function that returns the
+	// value of LOCATION field of the message sent on the
+	// interface.
+	Location func(*net.Interface) string
+}
+
+// A PreparedMessage represents a NOTIFY message encoded for sending
+// on a set of multicast network interfaces. It is immutable and may
+// be sent repeatedly and concurrently by the device that prepared it.
+type PreparedMessage struct {
+	dev *Device
+	nts string
+	oms []outMessage // encoded messages, one per interface
+}
+
+// Interfaces returns a list of the multicast network interfaces on
+// which the message is sent.
+func (pm *PreparedMessage) Interfaces() []net.Interface {
+	ift := make([]net.Interface, len(pm.oms))
+	for i := range pm.oms {
+		ift[i] = *pm.oms[i].ifi
+	}
+	return ift
+}
+
+// PrepareNotify encodes the NOTIFY SSDP message n for sending with
+// NotifyPrepared.
+func (dev *Device) PrepareNotify(n Notification) (*PreparedMessage, error) {
+	return dev.prepare(n, dev.group)
+}
+
+// prepare encodes the NOTIFY SSDP message n for sending to the group
+// address grp.
+func (dev *Device) prepare(n Notification, grp *net.UDPAddr) (*PreparedMessage, error) {
+	mifs, err := interfaces(n.Interfaces, dev.unicast)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	if _, err := dev.writeToMulti(buf.Bytes(), dev.group, mifs); err != nil {
-		return err
+	hdr := n.Header
+	if n.Body != nil && hdr.Get("Content-Length") == "" {
+		hdr = append(append(Header(nil), hdr...), HeaderField{Name: "CONTENT-LENGTH", Value: strconv.Itoa(len(n.Body))})
+	}
+	pm := &PreparedMessage{dev: dev, nts: hdr.Get("Nts"), oms: make([]outMessage, len(mifs))}
+	var b []byte
+	for i := range mifs {
+		if b == nil || n.Location != nil {
+			h := append(Header(nil), hdr...)
+			if n.Location != nil {
+				h.Set("LOCATION", n.Location(&mifs[i]))
+			}
+			var buf bytes.Buffer
+			if err := marshalHeaderAdvert(&buf, notifyMethod, grp.String(), h); err != nil {
+				return nil, err
+			}
+			buf.Write(n.Body)
+			b = buf.Bytes()
+		}
+		pm.oms[i] = outMessage{b: b, dst: grp, ifi: &mifs[i]}
 	}
-	return nil
+	return pm, nil
 }
 
-func (dev *Device) logf(format string, args ...interface{}) {
-	if dev.ErrorLog != nil {
-		dev.ErrorLog.Printf(format, args...)
+// NotifyPrepared sends the prepared messages pms with as few system
+// calls as possible. It returns the results in the order of pms and
+// their interfaces.
+func (dev *Device) NotifyPrepared(pms ...*PreparedMessage) ([]SendResult, error) {
+	n := 0
+	for _, pm := range pms {
+		if pm.dev != dev {
+			return nil, errors.New("message prepared by another device")
+		}
+		n += len(pm.oms)
+	}
+	var oms []outMessage
+	if len(pms) == 1 {
+		oms = pms[0].oms
 	} else {
-		log.Printf(format, args...)
+		oms = make([]outMessage, 0, n)
+		for _, pm := range pms {
+			oms = append(oms, pm.oms...)
+		}
+	}
+	rs, err := dev.writeBatch(oms)
+	i := 0
+	for _, pm := range pms {
+		dev.stats.wrote(notifyMethod, pm.nts, rs[i:i+len(pm.oms)])
+		i += len(pm.oms)
 	}
+	srs := sendResults(rs)
+	if err := sendError(srs, dev.StrictSend, err); err != nil {
+		return srs, err
+	}
+	return srs, nil
+}
+
+// Respond sends a response message with the ordered header hdr to
+// the requester of the M-SEARCH message req passed to the handler of
+// the device. Unlike the http.ResponseWriter passed to the handler,
+// it may be called after the handler returns and more than once, for
+// example to spread responses over the MX period or to answer with
+// one response per search target. It returns ErrMessageTooLong
+// without sending the message when the message exceeds
+// MaxResponseSize.
+func (dev *Device) Respond(req *http.Request, hdr Header) error {
+	in := inboundFromContext(req.Context())
+	if in == nil || in.grp != dev.group {
+		return errors.New("request not received by device")
+	}
+	resp := &responseWriter{
+		response: response{
+			conn: dev.conn,
+			mifs: dev.mifs,
+			path: in.path,
+		},
+		hdr:   make(http.Header),
+		ohdr:  hdr,
+		req:   req,
+		stats: dev.stats,
+		max:   dev.MaxResponseSize,
+	}
+	return resp.FlushError()
+}
+
+// Stats returns a snapshot of the statistics of the device.
+func (dev *Device) Stats() Stats {
+	return dev.stats.snapshot()
+}
+
+func (dev *Device) logEvent(r logRecord) {
+	writeLog(dev.Logger, dev.ErrorLog, &r)
 }
@@ -0,0 +1,263 @@
+// Copyright 2014 Mikio Hara. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ssdp
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// vendorDeviations holds the deviations found in the messages of the
+// vendor corpus. The other messages conform to the protocol.
+var vendorDeviations = map[string][]Deviation{
+	"epson-printer-notify-lenient.txt": {DeviationHeaderSpace, DeviationFoldedHeader},
+	"ipcam-notify-lenient.txt":         {DeviationUnterminated},
+	"netgear-notify-lenient.txt":       {DeviationBareLF},
+	"roku-response-lenient.txt":        {DeviationReasonPhrase},
+}
+
+// vendorCorpus returns the messages captured from devices of common
+// vendors, keyed by file name.
+func vendorCorpus(tb testing.TB) map[string][]byte {
+	files, err := filepath.Glob(filepath.Join("testdata", "vendor", "*.txt"))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	if len(files) == 0 {
+		tb.Fatal("no vendor corpus")
+	}
+	msgs := make(map[string][]byte)
+	for _, file := range files {
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		msgs[filepath.Base(file)] = b
+	}
+	return msgs
+}
+
+func addVendorCorpus(f *testing.F) {
+	for _, b := range vendorCorpus(f) {
+		f.Add(b)
+	}
+	for _, tt := range messageTests {
+		f.Add([]byte(tt))
+	}
+}
+
+func TestVendorCorpus(t *testing.T) {
+	var m message
+	for name, b := range vendorCorpus(t) {
+		if bytes.HasPrefix(b, []byte("HTTP/")) {
+			resp, devs, err := parseResponseMode(b, ParseLenient)
+			if err != nil {
+				t.Errorf("%s: %v", name, err)
+				continue
+			}
+			if !reflect.DeepEqual(devs, vendorDeviations[name]) {
+				t.Errorf("%s: got %v; want %v", name, devs, vendorDeviations[name])
+			}
+			if resp.StatusCode != http.StatusOK || resp.Header.Get("St") == "" || resp.Header.Get("Usn") == "" || resp.Header.Get("Location") == "" {
+				t.Errorf("%s: unexpected response: %v, %v", name, resp.Status, resp.Header)
+			}
+			if devs != nil {
+				continue
+			}
+			checkResponseEquivalence(t, &m, b)
+			checkResponseRoundTrip(t, b)
+			continue
+		}
+		req, devs, err := parseAdvertMode(b, ParseLenient)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if !reflect.DeepEqual(devs, vendorDeviations[name]) {
+			t.Errorf("%s: got %v; want %v", name, devs, vendorDeviations[name])
+		}
+		if req.Host != "239.255.255.250:1900" {
+			t.Errorf("%s: got %q; want 239.255.255.250:1900", name, req.Host)
+		}
+		switch req.Method {
+		case notifyMethod:
+			if req.Header.Get("Nt") == "" || req.Header.Get("Usn") == "" {
+				t.Errorf("%s: unexpected header: %v", name, req.Header)
+			}
+			switch req.Header.Get("Nts") {
+			case "ssdp:alive":
+				if req.Header.Get("Location") == "" || req.Header.Get("Cache-Control") == "" {
+					t.Errorf("%s: unexpected header: %v", name, req.Header)
+				}
+			case "ssdp:byebye":
+			default:
+				t.Errorf("%s: unexpected header: %v", name, req.Header)
+			}
+		case msearchMethod:
+			if req.Header.Get("Man") != `"ssdp:discover"` || req.Header.Get("St") == "" {
+				t.Errorf("%s: unexpected header: %v", name, req.Header)
+			}
+		}
+		if devs != nil {
+			continue
+		}
+		checkAdvertEquivalence(t, &m, b)
+		checkAdvertRoundTrip(t, b)
+	}
+}
+
+func FuzzParseRequestLine(f *testing.F) {
+	for _, b := range vendorCorpus(f) {
+		l, _, _ := cutLine(b)
+		f.Add(string(l))
+	}
+	f.Fuzz(func(t *testing.T, l string) {
+		method, uri, proto, ok := parseRequestLine(l)
+		if !ok {
+			if strings.Count(l, " ") >= 2 {
+				t.Fatalf("failed to parse %q", l)
+			}
+			return
+		}
+		if strings.Contains(method, " ") || strings.Contains(uri, " ") {
+			t.Fatalf("got %q, %q, %q for %q", method, uri, proto, l)
+		}
+		if s := method + " " + uri + " " + proto; s != l {
+			t.Fatalf("got %q; want %q", s, l)
+		}
+	})
+}
+
+func FuzzParseHeader(f *testing.F) {
+	addVendorCorpus(f)
+	f.Fuzz(func(t *testing.T, b []byte) {
+		h := parseHeader(b)
+		var buf bytes.Buffer
+		buf.WriteString("NOTIFY * HTTP/1.1\r\n")
+		if err := h.Write(&buf); err != nil {
+			for _, f := range h {
+				if !validFieldNameString(f.Name) {
+					return
+				}
+			}
+			t.Fatal(err)
+		}
+		buf.WriteString("\r\n")
+		h1 := parseHeader(buf.Bytes())
+		if len(h1) != len(h) {
+			t.Fatalf("got %v; want %v for %q", h1, h, b)
+		}
+		for i := range h {
+			if h1[i].Name != h[i].Name {
+				t.Fatalf("got %v; want %v for %q", h1, h, b)
+			}
+			if v := strings.TrimSpace(headerValueReplacer.Replace(h[i].Value)); h1[i].Value != v {
+				t.Fatalf("got %v; want %v for %q", h1, h, b)
+			}
+		}
+	})
+}
+
+func FuzzNormalize(f *testing.F) {
+	addVendorCorpus(f)
+	f.Fuzz(func(t *testing.T, b []byte) {
+		for _, response := range []bool{false, true} {
+			nb, _ := normalize(b, response)
+			if nnb, devs := normalize(nb, response); !bytes.Equal(nnb, nb) {
+				t.Fatalf("got %q, %v; want %q for %q", nnb, devs, nb, b)
+			}
+			var err error
+			if response {
+				_, err = parseResponse(nb)
+			} else {
+				_, err = parseAdvert(nb)
+			}
+			var m message
+			if ferr := m.parse(nb, response); (err == nil) != (ferr == nil) {
+				t.Fatalf("got %v; want %v for %q", ferr, err, nb)
+			}
+		}
+	})
+}
+
+func FuzzMarshalAdvert(f *testing.F) {
+	addVendorCorpus(f)
+	f.Fuzz(func(t *testing.T, b []byte) {
+		checkAdvertRoundTrip(t, b)
+	})
+}
+
+func FuzzMarshalResponse(f *testing.F) {
+	addVendorCorpus(f)
+	f.Fuzz(func(t *testing.T, b []byte) {
+		checkResponseRoundTrip(t, b)
+	})
+}
+
+// checkAdvertRoundTrip checks that the advertisement message b is
+// marshaled into the message carrying the same request.
+func checkAdvertRoundTrip(t *testing.T, b []byte) {
+	t.Helper()
+	req, err := parseAdvert(b)
+	if err != nil {
+		return
+	}
+	var buf bytes.Buffer
+	if err := marshalOrderedAdvert(&buf, req, parseHeader(b)); err != nil {
+		t.Fatal(err)
+	}
+	req1, err := parseAdvert(buf.Bytes())
+	if err != nil {
+		t.Fatalf("%v for %q marshaled from %q", err, buf.Bytes(), b)
+	}
+	if req1.Method != req.Method || req1.Host != req.Host || !reflect.DeepEqual(req1.Header, req.Header) {
+		t.Fatalf("got %v, %v, %v; want %v, %v, %v for %q", req1.Method, req1.Host, req1.Header, req.Method, req.Host, req.Header, b)
+	}
+	var buf1 bytes.Buffer
+	if err := marshalOrderedAdvert(&buf1, req1, parseHeader(buf.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf1.Bytes(), buf.Bytes()) {
+		t.Fatalf("got %q; want %q", buf1.Bytes(), buf.Bytes())
+	}
+}
+
+// checkResponseRoundTrip checks that the response message b is
+// marshaled into the message carrying the same response. HOST field
+// is not relayed in responses.
+func checkResponseRoundTrip(t *testing.T, b []byte) {
+	t.Helper()
+	resp, err := parseResponse(b)
+	if err != nil {
+		return
+	}
+	rdr := &ResponseRedirector{resp: resp, raw: b}
+	out, err := rdr.marshal()
+	if err != nil {
+		t.Fatalf("%v for %q", err, b)
+	}
+	out = append([]byte(nil), out...)
+	resp1, err := parseResponse(out)
+	if err != nil {
+		t.Fatalf("%v for %q marshaled from %q", err, out, b)
+	}
+	hdr := resp.Header.Clone()
+	hdr.Del("Host")
+	if resp1.StatusCode != resp.StatusCode || resp1.Proto != resp.Proto || !reflect.DeepEqual(resp1.Header, hdr) {
+		t.Fatalf("got %v, %v, %v; want %v, %v, %v for %q", resp1.Proto, resp1.StatusCode, resp1.Header, resp.Proto, resp.StatusCode, hdr, b)
+	}
+	rdr1 := &ResponseRedirector{resp: resp1, raw: out}
+	if out1, _ := rdr1.marshal(); !bytes.Equal(out1, out) {
+		t.Fatalf("got %q; want %q", out1, out)
+	}
+	if !bytes.Equal(rdr1.body, rdr.body) {
+		t.Fatalf("got %q; want %q for %q", rdr1.body, rdr.body, b)
+	}
+}
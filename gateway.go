@@ -0,0 +1,409 @@
+// Copyright 2014 Mikio Hara. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ssdp
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"net"
+	"net/http"
+	"runtime"
+	"sync"
+	"time"
+)
+
+const (
+	frameKeepalive = iota // keepalive, no payload
+	frameAdvert           // NOTIFY or M-SEARCH message
+	frameResponse         // response message
+)
+
+const (
+	frameHeaderLen = 3 // type and payload length
+
+	keepaliveInterval = 30 * time.Second
+	peerTimeout       = 3 * keepaliveInterval
+	writeTimeout      = 10 * time.Second
+	maxRetryInterval  = time.Minute
+)
+
+// A Gateway represents a unicast SSDP gateway. It carries SSDP
+// messages between the network of a redirector and remote sites over
+// stream-oriented connections such as TCP or TLS.
+//
+// The gateway implements RedirectHandler and must be used as the
+// handler of the redirector. Messages received from a remote site are
+// injected into the local network only.
+type Gateway struct {
+	// ErrorLog specified an optional logger for errors. If it is
+	// nil, logging goes to os.Stderr via the log package's
+	// standard logger.
+	ErrorLog *log.Logger
+
+	// Logger optionally specifies a structured logger. If it is
+	// not nil, it is used instead of ErrorLog.
+	Logger *slog.Logger
+
+	// TLSConfig optionally specifies the TLS configuration for
+	// connections to remote sites. If it is nil, the connections
+	// are not encrypted.
+	TLSConfig *tls.Config
+
+	// RetryInterval specifies the initial interval of
+	// reconnection attempts by DialAndServe. The interval doubles
+	// on each failure up to one minute. If it is zero, one second
+	// will be used.
+	RetryInterval time.Duration
+
+	rdr *Redirector
+
+	mu     sync.Mutex
+	peers  map[*gatewayPeer]bool
+	lns    map[net.Listener]bool
+	closed bool
+	done   chan struct{}
+}
+
+// NewGateway returns a new gateway for the redirector.
+func NewGateway(rdr *Redirector) *Gateway {
+	return &Gateway{
+		rdr:   rdr,
+		peers: make(map[*gatewayPeer]bool),
+		lns:   make(map[net.Listener]bool),
+		done:  make(chan struct{}),
+	}
+}
+
+// Serve accepts connections from remote gateways on the listener ln
+// and carries SSDP messages over them. It returns nil after the
+// gateway is closed.
+func (gw *Gateway) Serve(ln net.Listener) error {
+	if gw.TLSConfig != nil {
+		ln = tls.NewListener(ln, gw.TLSConfig)
+	}
+	gw.mu.Lock()
+	if gw.closed {
+		gw.mu.Unlock()
+		ln.Close()
+		return nil
+	}
+	gw.lns[ln] = true
+	gw.mu.Unlock()
+	defer func() {
+		gw.mu.Lock()
+		delete(gw.lns, ln)
+		gw.mu.Unlock()
+	}()
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			if gw.isClosed() {
+				return nil
+			}
+			if nerr, ok := err.(net.Error); ok && nerr.Temporary() {
+				gw.logEvent(logRecord{level: slog.LevelWarn, kind: LogKindConnect, msg: "accept failed", err: err})
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+		go gw.serve(c)
+	}
+}
+
+// DialAndServe connects to the remote gateway at address on the
+// named network, and carries SSDP messages over the connection. It
+// reconnects when the connection fails and returns nil after the
+// gateway is closed.
+func (gw *Gateway) DialAndServe(network, address string) error {
+	initial := gw.RetryInterval
+	if initial <= 0 {
+		initial = time.Second
+	}
+	d := net.Dialer{Timeout: writeTimeout}
+	retry := initial
+	for {
+		var c net.Conn
+		var err error
+		if gw.TLSConfig != nil {
+			c, err = tls.DialWithDialer(&d, network, address, gw.TLSConfig)
+		} else {
+			c, err = d.Dial(network, address)
+		}
+		if err != nil {
+			gw.logEvent(logRecord{level: slog.LevelWarn, kind: LogKindConnect, msg: "dial failed", err: err})
+		} else {
+			retry = initial
+			gw.serve(c)
+		}
+		select {
+		case <-gw.done:
+			return nil
+		case <-time.After(retry):
+		}
+		if retry *= 2; retry > maxRetryInterval {
+			retry = maxRetryInterval
+		}
+	}
+}
+
+// Close closes the gateway and the connections to remote sites. It
+// doesn't close the redirector.
+func (gw *Gateway) Close() error {
+	gw.mu.Lock()
+	defer gw.mu.Unlock()
+	if gw.closed {
+		return nil
+	}
+	gw.closed = true
+	close(gw.done)
+	for ln := range gw.lns {
+		ln.Close()
+	}
+	for p := range gw.peers {
+		p.Close()
+	}
+	return nil
+}
+
+// RedirectAdvert implements the RedirectAdvert method of
+// RedirectHandler interface. It carries the advertisement message to
+// the remote sites.
+func (gw *Gateway) RedirectAdvert(adv *AdvertRedirector) {
+	req := adv.req
+	gw.rdr.srch.register(req, adv.path.src, adv.path.ifIndex, unicastReply(adv.conn, adv.path.src))
+	gw.rdr.guard.stamp(req.Header)
+	var buf bytes.Buffer
+	if err := marshalOrderedAdvert(&buf, req, parseHeader(adv.raw)); err != nil {
+		gw.logEvent(logRecord{level: slog.LevelWarn, kind: LogKindWrite, msg: "marshal advert failed", path: adv.path, mifs: gw.rdr.mifs, method: req.Method, hdr: req.Header, err: err})
+		return
+	}
+	gw.broadcast(frameAdvert, buf.Bytes())
+}
+
+// RedirectResponse implements the RedirectResponse method of
+// RedirectHandler interface. It does nothing; after it returns, the
+// redirector relays the response to the requesters of the searches
+// it forwarded, including the remote sites, whose searches are
+// registered when they are injected into the local network.
+// Responses that answer no such search are not carried to the remote
+// sites.
+func (gw *Gateway) RedirectResponse(resp *ResponseRedirector) {}
+
+func (gw *Gateway) broadcast(typ byte, b []byte) {
+	gw.mu.Lock()
+	peers := make([]*gatewayPeer, 0, len(gw.peers))
+	for p := range gw.peers {
+		peers = append(peers, p)
+	}
+	gw.mu.Unlock()
+	for _, p := range peers {
+		if err := p.writeFrame(typ, b); err != nil {
+			gw.logEvent(logRecord{level: slog.LevelWarn, kind: LogKindWrite, msg: "write to peer failed", peer: p.RemoteAddr(), err: err})
+			p.Close()
+		}
+	}
+}
+
+func (gw *Gateway) serve(c net.Conn) {
+	p := &gatewayPeer{Conn: c}
+	gw.mu.Lock()
+	if gw.closed {
+		gw.mu.Unlock()
+		c.Close()
+		return
+	}
+	gw.peers[p] = true
+	gw.mu.Unlock()
+	defer func() {
+		gw.mu.Lock()
+		delete(gw.peers, p)
+		gw.mu.Unlock()
+		c.Close()
+	}()
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		t := time.NewTicker(keepaliveInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-t.C:
+				if err := p.writeFrame(frameKeepalive, nil); err != nil {
+					p.Close()
+					return
+				}
+			}
+		}
+	}()
+	br := bufio.NewReader(c)
+	for {
+		c.SetReadDeadline(time.Now().Add(peerTimeout))
+		typ, b, err := readFrame(br)
+		if err != nil {
+			if err != io.EOF && !gw.isClosed() {
+				gw.logEvent(logRecord{level: slog.LevelWarn, kind: LogKindRead, msg: "read from peer failed", peer: c.RemoteAddr(), err: err})
+			}
+			return
+		}
+		switch typ {
+		case frameAdvert:
+			gw.injectAdvert(p, b)
+		case frameResponse:
+			gw.injectResponse(p, b)
+		}
+	}
+}
+
+// injectAdvert writes the advertisement message from the remote site
+// to the local network through each of the joined interfaces.
+func (gw *Gateway) injectAdvert(p *gatewayPeer, b []byte) {
+	defer gw.recover(p)
+	req, _, err := parseAdvertMode(b, gw.rdr.mode)
+	if err != nil {
+		gw.logEvent(logRecord{level: slog.LevelWarn, kind: LogKindParse, msg: "parse advert failed", peer: p.RemoteAddr(), err: err})
+		return
+	}
+	rdr := gw.rdr
+	if rdr.guard.revisited(req.Header, rdr.MaxHops) {
+		return
+	}
+	src := tcpToUDPAddr(p.RemoteAddr())
+	rdr.srch.register(req, src, 0, func(b []byte) (int, error) { return len(b), p.writeFrame(frameResponse, b) })
+	req.Host = rdr.group.String()
+	adv := newAdvertRedirector(rdr.conn, rdr.mifs, rdr.group, &path{src: src, dst: &net.UDPAddr{IP: rdr.group.IP}}, req)
+	adv.raw = b
+	adv.guard = rdr.guard
+	for i := range rdr.mifs {
+		ifi := &rdr.mifs[i]
+		if _, err := adv.WriteTo(rdr.group, ifi); err != nil {
+			gw.logEvent(logRecord{level: slog.LevelWarn, kind: LogKindWrite, msg: "inject advert failed", path: &path{src: src, ifIndex: ifi.Index}, mifs: rdr.mifs, method: req.Method, hdr: req.Header, err: err})
+		}
+	}
+}
+
+// injectResponse relays the response message from the remote site to
+// the local requesters.
+func (gw *Gateway) injectResponse(p *gatewayPeer, b []byte) {
+	defer gw.recover(p)
+	resp, _, err := parseResponseMode(b, gw.rdr.mode)
+	if err != nil {
+		gw.logEvent(logRecord{level: slog.LevelWarn, kind: LogKindParse, msg: "parse response failed", peer: p.RemoteAddr(), err: err})
+		return
+	}
+	rdr := gw.rdr
+	if rdr.guard.revisited(resp.Header, rdr.MaxHops) {
+		resp.Body.Close()
+		return
+	}
+	resprdr := &ResponseRedirector{
+		response: response{conn: rdr.conn, mifs: rdr.mifs, path: &path{src: tcpToUDPAddr(p.RemoteAddr()), dst: &net.UDPAddr{}}},
+		resp:     resp,
+		raw:      b,
+		guard:    rdr.guard,
+	}
+	rdr.relay(resprdr, rdr.srch.lookup(resp.Header.Get("St"), 0))
+}
+
+// parseAdvertMode parses the advertisement message in the mode.
+func parseAdvertMode(b []byte, mode ParseMode) (*http.Request, []Deviation, error) {
+	if mode != ParseLenient {
+		req, err := parseAdvert(b)
+		return req, nil, err
+	}
+	b, devs := normalize(b, false)
+	req, err := parseAdvert(b)
+	if err != nil {
+		return nil, devs, err
+	}
+	return withDeviations(req, devs), devs, nil
+}
+
+// parseResponseMode parses the response message in the mode.
+func parseResponseMode(b []byte, mode ParseMode) (*http.Response, []Deviation, error) {
+	if mode != ParseLenient {
+		resp, err := parseResponse(b)
+		return resp, nil, err
+	}
+	b, devs := normalize(b, true)
+	resp, err := parseResponse(b)
+	return resp, devs, err
+}
+
+func (gw *Gateway) recover(p *gatewayPeer) {
+	if err := recover(); err != nil {
+		const size = 64 << 10
+		b := make([]byte, size)
+		b = b[:runtime.Stack(b, false)]
+		gw.logEvent(logRecord{level: slog.LevelError, kind: LogKindPanic, msg: "panic serving", peer: p.RemoteAddr(), err: fmt.Errorf("%v", err), stack: b})
+	}
+}
+
+func (gw *Gateway) isClosed() bool {
+	gw.mu.Lock()
+	defer gw.mu.Unlock()
+	return gw.closed
+}
+
+func (gw *Gateway) logEvent(r logRecord) {
+	writeLog(gw.Logger, gw.ErrorLog, &r)
+}
+
+// A gatewayPeer represents a connection to a remote gateway.
+type gatewayPeer struct {
+	net.Conn
+	wmu sync.Mutex
+}
+
+func (p *gatewayPeer) writeFrame(typ byte, b []byte) error {
+	if len(b) > 1<<16-1 {
+		return fmt.Errorf("message too long: %d", len(b))
+	}
+	frame := make([]byte, frameHeaderLen+len(b))
+	frame[0] = typ
+	binary.BigEndian.PutUint16(frame[1:3], uint16(len(b)))
+	copy(frame[frameHeaderLen:], b)
+	p.wmu.Lock()
+	defer p.wmu.Unlock()
+	p.SetWriteDeadline(time.Now().Add(writeTimeout))
+	_, err := p.Write(frame)
+	return err
+}
+
+func readFrame(br *bufio.Reader) (byte, []byte, error) {
+	var h [frameHeaderLen]byte
+	if _, err := io.ReadFull(br, h[:]); err != nil {
+		return 0, nil, err
+	}
+	switch h[0] {
+	case frameKeepalive, frameAdvert, frameResponse:
+	default:
+		return 0, nil, errors.New("unknown frame type")
+	}
+	b := make([]byte, binary.BigEndian.Uint16(h[1:3]))
+	if _, err := io.ReadFull(br, b); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, nil, err
+	}
+	return h[0], b, nil
+}
+
+func tcpToUDPAddr(addr net.Addr) *net.UDPAddr {
+	if a, ok := addr.(*net.TCPAddr); ok {
+		return &net.UDPAddr{IP: a.IP, Port: a.Port, Zone: a.Zone}
+	}
+	return &net.UDPAddr{}
+}
@@ -0,0 +1,166 @@
+// Copyright 2014 Mikio Hara. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ssdp
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGatewayFrame(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	p := &gatewayPeer{Conn: c1}
+	go func() {
+		p.writeFrame(frameAdvert, []byte("NOTIFY * HTTP/1.1\r\n\r\n"))
+		p.writeFrame(frameKeepalive, nil)
+		c1.Write([]byte{0xff, 0, 0})
+	}()
+	br := bufio.NewReader(c2)
+	if typ, b, err := readFrame(br); err != nil || typ != frameAdvert || !bytes.Equal(b, []byte("NOTIFY * HTTP/1.1\r\n\r\n")) {
+		t.Fatalf("got %v, %q, %v; want %v, NOTIFY, nil", typ, b, err, frameAdvert)
+	}
+	if typ, b, err := readFrame(br); err != nil || typ != frameKeepalive || len(b) != 0 {
+		t.Fatalf("got %v, %q, %v; want %v, empty, nil", typ, b, err, frameKeepalive)
+	}
+	if _, _, err := readFrame(br); err == nil {
+		t.Fatal("got nil; want error")
+	}
+}
+
+func TestGateway(t *testing.T) {
+	ln1 := Listener{Port: "1905", LocalPort: "1905"}
+	rdr1, err := ln1.ListenRedirector(nil)
+	if err != nil {
+		t.Skip(err)
+	}
+	defer rdr1.Close()
+	gw1 := NewGateway(rdr1)
+	defer gw1.Close()
+	go rdr1.Serve(gw1)
+	ln2 := Listener{Port: "1906", LocalPort: "1906", MulticastLoopback: true}
+	rdr2, err := ln2.ListenRedirector(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rdr2.Close()
+	gw2 := NewGateway(rdr2)
+	gw2.RetryInterval = 50 * time.Millisecond
+	defer gw2.Close()
+	go rdr2.Serve(gw2)
+
+	tln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go gw1.Serve(tln)
+	go gw2.DialAndServe("tcp", tln.Addr().String())
+
+	cpln := Listener{Port: "1906", LocalPort: "1906"}
+	cp, err := cpln.ListenControlPoint(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cp.Close()
+	ch := make(chan *http.Request, 4)
+	go cp.Serve(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		select {
+		case ch <- req:
+		default:
+		}
+	}))
+
+	c, err := net.ListenPacket("udp4", "0.0.0.0:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	dst := &net.UDPAddr{IP: rdr1.GroupAddr().IP, Port: 1905}
+	msg := []byte("NOTIFY * HTTP/1.1\r\nHOST: 239.255.255.250:1905\r\nNT: upnp:rootdevice\r\nNTS: ssdp:alive\r\nUSN: uuid:x::upnp:rootdevice\r\n\r\n")
+	for i := 0; i < 2; i++ {
+		// Wait for the tunnel to come up, and then tear it down
+		// to see whether it comes back.
+		deadline := time.Now().Add(3 * time.Second)
+		for peers(gw1) == 0 || peers(gw2) == 0 {
+			if time.Now().After(deadline) {
+				t.Fatal("tunnel not established")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if _, err := c.WriteTo(msg, dst); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case req := <-ch:
+			if req.Host != rdr2.GroupAddr().String() || len(hopList(req.Header)) != 2 {
+				t.Errorf("unexpected message: %v, %v", req.Host, req.Header)
+			}
+		case <-time.After(time.Second):
+			t.Skip("no message carried")
+		}
+		gw1.mu.Lock()
+		for p := range gw1.peers {
+			p.Close()
+		}
+		gw1.mu.Unlock()
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func peers(gw *Gateway) int {
+	gw.mu.Lock()
+	defer gw.mu.Unlock()
+	return len(gw.peers)
+}
+
+// A downConn fails to write on the interface named "down".
+type downConn struct {
+	recordConn
+}
+
+func (c *downConn) writeTo(b []byte, dst *net.UDPAddr, ifi *net.Interface) (int, error) {
+	if ifi != nil && ifi.Name == "down" {
+		return 0, errors.New("network is down")
+	}
+	return c.recordConn.writeTo(b, dst, ifi)
+}
+
+func TestGatewayInjectAdvert(t *testing.T) {
+	c := &downConn{}
+	grp := &net.UDPAddr{IP: net.ParseIP(DefaultIPv4Group), Port: 1900}
+	mifs := []net.Interface{{Index: 1, Name: "up"}, {Index: 2, Name: "down"}, {Index: 3, Name: "up2"}}
+	guard, err := newLoopGuard()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var logbuf bytes.Buffer
+	gw := NewGateway(&Redirector{conn: c, group: grp, mifs: mifs, guard: guard})
+	gw.ErrorLog = log.New(&logbuf, "", 0)
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	gw.injectAdvert(&gatewayPeer{Conn: c1}, []byte("NOTIFY * HTTP/1.1\r\nHOST: 192.0.2.1:1900\r\nNT: upnp:rootdevice\r\nNTS: ssdp:alive\r\nUSN: uuid:x::upnp:rootdevice\r\n\r\n"))
+	dgs := c.datagrams()
+	if len(dgs) != 2 || dgs[0].ifi.Name != "up" || dgs[1].ifi.Name != "up2" {
+		t.Fatalf("unexpected datagrams: %+v", dgs)
+	}
+	for _, dg := range dgs {
+		if !bytes.Contains(dg.b, []byte("HOST: "+grp.String()+"\r\n")) || !bytes.Contains(bytes.ToLower(dg.b), []byte(strings.ToLower(hopHeader))) {
+			t.Errorf("unexpected datagram: %q", dg.b)
+		}
+	}
+	if s := logbuf.String(); strings.Count(s, "\n") != 1 || !strings.Contains(s, "inject advert failed: network is down") || !strings.Contains(s, "interface=down") {
+		t.Errorf("unexpected log: %q", s)
+	}
+}
@@ -0,0 +1,487 @@
+// Copyright 2014 Mikio Hara. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ssdp
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"log"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+const defaultSubscriptionTimeout = 1800 * time.Second
+
+// A Property represents an evented state variable.
+type Property struct {
+	Name  string // name of state variable
+	Value string // value of state variable
+}
+
+// An EventPublisher represents a GENA event publisher for a UPnP
+// service. It implements http.Handler and must be installed on the
+// event subscription URL of the service.
+type EventPublisher struct {
+	// Timeout specifies the maximum duration of subscriptions.
+	// If it is zero, 1800 seconds will be used.
+	Timeout time.Duration
+
+	// Client specifies an optional HTTP client for event
+	// message delivery. If it is nil, http.DefaultClient will be
+	// used.
+	Client *http.Client
+
+	// ErrorLog specified an optional logger for errors. If it is
+	// nil, logging goes to os.Stderr via the log package's
+	// standard logger.
+	ErrorLog *log.Logger
+
+	// Logger optionally specifies a structured logger. If it is
+	// not nil, it is used instead of ErrorLog.
+	Logger *slog.Logger
+
+	mu    sync.Mutex
+	subs  map[string]*subscription // subscriptions indexed by SID
+	props []Property               // current values of evented state variables
+	mseq  uint32                   // multicast event sequence number
+	mseqs bool                     // whether the multicast event has been sent
+}
+
+// ServeHTTP implements the ServeHTTP method of http.Handler
+// interface. It handles SUBSCRIBE and UNSUBSCRIBE requests.
+func (pub *EventPublisher) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case subscribeMethod:
+		if req.Header.Get("Sid") != "" {
+			pub.renew(w, req)
+		} else {
+			pub.subscribe(w, req)
+		}
+	case unsubscribeMethod:
+		pub.unsubscribe(w, req)
+	default:
+		w.Header().Set("Allow", subscribeMethod+", "+unsubscribeMethod)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (pub *EventPublisher) subscribe(w http.ResponseWriter, req *http.Request) {
+	if req.Header.Get("Nt") != "upnp:event" {
+		w.WriteHeader(http.StatusPreconditionFailed)
+		return
+	}
+	cbs, err := parseCallback(req.Header.Get("Callback"))
+	if err != nil {
+		w.WriteHeader(http.StatusPreconditionFailed)
+		return
+	}
+	sid, err := newSID()
+	if err != nil {
+		pub.logEvent(logRecord{level: slog.LevelWarn, kind: LogKindEvent, msg: "subscribe failed", err: err})
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	tmo := pub.timeout(req.Header.Get("Timeout"))
+	sub := &subscription{
+		sid:     sid,
+		cbs:     cbs,
+		expires: time.Now().Add(tmo),
+		wake:    make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+	pub.mu.Lock()
+	if pub.subs == nil {
+		pub.subs = make(map[string]*subscription)
+	}
+	pub.subs[sid] = sub
+	sub.timer = time.AfterFunc(tmo, func() { pub.expire(sid) })
+	// The initial event message carries all the evented state
+	// variables and must take the first sequence number. It is
+	// delivered after the response.
+	b, _ := marshalPropertySet(pub.props)
+	sub.enqueue(b)
+	pub.mu.Unlock()
+	writeSubscription(w, sid, tmo)
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+	go pub.deliver(sub)
+}
+
+func (pub *EventPublisher) renew(w http.ResponseWriter, req *http.Request) {
+	if req.Header.Get("Nt") != "" || req.Header.Get("Callback") != "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	sid := req.Header.Get("Sid")
+	tmo := pub.timeout(req.Header.Get("Timeout"))
+	pub.mu.Lock()
+	sub, ok := pub.subs[sid]
+	if ok {
+		sub.expires = time.Now().Add(tmo)
+		sub.timer.Reset(tmo)
+	}
+	pub.mu.Unlock()
+	if !ok {
+		w.WriteHeader(http.StatusPreconditionFailed)
+		return
+	}
+	writeSubscription(w, sid, tmo)
+}
+
+func (pub *EventPublisher) unsubscribe(w http.ResponseWriter, req *http.Request) {
+	if req.Header.Get("Nt") != "" || req.Header.Get("Callback") != "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if !pub.cancel(req.Header.Get("Sid")) {
+		w.WriteHeader(http.StatusPreconditionFailed)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// expire cancels the subscription when its timer fires. The timer
+// may fire while a renewal waits for the lock, so the subscription
+// is kept until the deadline of the last renewal.
+func (pub *EventPublisher) expire(sid string) {
+	pub.mu.Lock()
+	defer pub.mu.Unlock()
+	sub, ok := pub.subs[sid]
+	if !ok {
+		return
+	}
+	if d := time.Until(sub.expires); d > 0 {
+		sub.timer.Reset(d)
+		return
+	}
+	pub.remove(sub)
+}
+
+func (pub *EventPublisher) cancel(sid string) bool {
+	pub.mu.Lock()
+	defer pub.mu.Unlock()
+	sub, ok := pub.subs[sid]
+	if !ok {
+		return false
+	}
+	pub.remove(sub)
+	return true
+}
+
+// remove must be called with the publisher lock held.
+func (pub *EventPublisher) remove(sub *subscription) {
+	delete(pub.subs, sub.sid)
+	sub.timer.Stop()
+	close(sub.done)
+}
+
+func (pub *EventPublisher) timeout(s string) time.Duration {
+	max := pub.Timeout
+	if max <= 0 {
+		max = defaultSubscriptionTimeout
+	}
+	if !strings.HasPrefix(s, "Second-") {
+		return max
+	}
+	n, err := strconv.Atoi(s[len("Second-"):])
+	if err != nil || n <= 0 || time.Duration(n)*time.Second > max {
+		return max
+	}
+	return time.Duration(n) * time.Second
+}
+
+// Publish updates the evented state variables and sends an event
+// message to each subscriber.
+func (pub *EventPublisher) Publish(props []Property) error {
+	if len(props) == 0 {
+		return errors.New("no state variables")
+	}
+	b, err := marshalPropertySet(props)
+	if err != nil {
+		return err
+	}
+	pub.mu.Lock()
+	defer pub.mu.Unlock()
+loop:
+	for _, prop := range props {
+		for i := range pub.props {
+			if pub.props[i].Name == prop.Name {
+				pub.props[i].Value = prop.Value
+				continue loop
+			}
+		}
+		pub.props = append(pub.props, prop)
+	}
+	for _, sub := range pub.subs {
+		sub.enqueue(b)
+	}
+	return nil
+}
+
+// PublishMulticast sends a multicast event message through the
+// device. The header hdr must contain USN, SVCID and
+// BOOTID.UPNP.ORG headers, and may contain LVL header. If mifs is
+// nil, it tries to use all available multicast network interfaces.
+func (pub *EventPublisher) PublishMulticast(dev *Device, hdr http.Header, props []Property, mifs []net.Interface) error {
+	if len(props) == 0 {
+		return errors.New("no state variables")
+	}
+	if _, err := marshalPropertySet(props); err != nil {
+		return err
+	}
+	pub.mu.Lock()
+	if pub.mseqs {
+		pub.mseq = nextSeq(pub.mseq)
+	}
+	pub.mseqs = true
+	seq := pub.mseq
+	pub.mu.Unlock()
+	h := make(http.Header)
+	for k, v := range hdr {
+		h[k] = v
+	}
+	h.Set("Seq", strconv.FormatUint(uint64(seq), 10))
+	if h.Get("Lvl") == "" {
+		h.Set("Lvl", "upnp:/info")
+	}
+	return dev.notifyEvent(h, props, mifs)
+}
+
+// Close cancels all the subscriptions.
+func (pub *EventPublisher) Close() error {
+	pub.mu.Lock()
+	defer pub.mu.Unlock()
+	for sid, sub := range pub.subs {
+		delete(pub.subs, sid)
+		sub.timer.Stop()
+		close(sub.done)
+	}
+	return nil
+}
+
+func (pub *EventPublisher) deliver(sub *subscription) {
+	for {
+		select {
+		case <-sub.done:
+			return
+		case <-sub.wake:
+		}
+		for {
+			pub.mu.Lock()
+			if len(sub.evs) == 0 {
+				pub.mu.Unlock()
+				break
+			}
+			ev := sub.evs[0]
+			sub.evs = sub.evs[1:]
+			pub.mu.Unlock()
+			if err := pub.send(sub, ev); err != nil {
+				pub.logEvent(logRecord{level: slog.LevelWarn, kind: LogKindEvent, msg: "event delivery failed", hdr: http.Header{"Sid": {sub.sid}}, err: err})
+			}
+		}
+	}
+}
+
+func (pub *EventPublisher) send(sub *subscription, ev *event) error {
+	c := pub.Client
+	if c == nil {
+		c = http.DefaultClient
+	}
+	var lastErr error
+	for _, cb := range sub.cbs {
+		req, err := http.NewRequest(notifyMethod, cb.String(), bytes.NewReader(ev.body))
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		req.Header["CONTENT-TYPE"] = []string{`text/xml; charset="utf-8"`}
+		req.Header["NT"] = []string{"upnp:event"}
+		req.Header["NTS"] = []string{"upnp:propchange"}
+		req.Header["SID"] = []string{sub.sid}
+		req.Header["SEQ"] = []string{strconv.FormatUint(uint64(ev.seq), 10)}
+		resp, err := c.Do(req)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			lastErr = fmt.Errorf("unexpected status from %v: %v", cb, resp.Status)
+			continue
+		}
+		return nil
+	}
+	return lastErr
+}
+
+func (pub *EventPublisher) logEvent(r logRecord) {
+	writeLog(pub.Logger, pub.ErrorLog, &r)
+}
+
+type event struct {
+	seq  uint32
+	body []byte
+}
+
+type subscription struct {
+	sid   string
+	cbs   []*url.URL    // delivery URLs
+	seq   uint32        // next event sequence number
+	evs   []*event      // pending event messages
+	timer *time.Timer   // subscription timer
+	wake  chan struct{} // event notification
+	done  chan struct{} // cancellation notification
+
+	expires time.Time // deadline of the last subscription or renewal
+}
+
+// enqueue must be called with the publisher lock held.
+func (sub *subscription) enqueue(b []byte) {
+	sub.evs = append(sub.evs, &event{seq: sub.seq, body: b})
+	sub.seq = nextSeq(sub.seq)
+	select {
+	case sub.wake <- struct{}{}:
+	default:
+	}
+}
+
+// notifyEvent issues a multicast event message as described in
+// section 4.3 of UPnP Device Architecture 1.1. The header hdr must
+// contain USN, SVCID, LVL, SEQ and BOOTID.UPNP.ORG headers. If mifs
+// is nil, it tries to use all available multicast network
+// interfaces.
+func (dev *Device) notifyEvent(hdr http.Header, props []Property, mifs []net.Interface) error {
+	body, err := marshalPropertySet(props)
+	if err != nil {
+		return err
+	}
+	h := make(http.Header)
+	for k, v := range hdr {
+		h[k] = v
+	}
+	h.Set("Content-Type", `text/xml; charset="utf-8"`)
+	h.Set("Content-Length", strconv.Itoa(len(body)))
+	h.Set("Nt", "upnp:event")
+	h.Set("Nts", "upnp:propchange")
+	pm, err := dev.prepare(Notification{Header: HeaderFromHTTP(h), Body: body, Interfaces: mifs}, eventGroup(dev.group))
+	if err != nil {
+		return err
+	}
+	_, err = dev.NotifyPrepared(pm)
+	return err
+}
+
+func eventGroup(grp *net.UDPAddr) *net.UDPAddr {
+	port, _ := strconv.Atoi(DefaultEventPort)
+	switch {
+	case grp.IP.To4() != nil:
+		return &net.UDPAddr{IP: net.ParseIP(DefaultIPv4EventGroup), Port: port}
+	case grp.IP.IsLinkLocalMulticast():
+		return &net.UDPAddr{IP: net.ParseIP(DefaultIPv6LinkLocalEventGroup), Port: port}
+	default:
+		return &net.UDPAddr{IP: net.ParseIP(DefaultIPv6SiteLocalEventGroup), Port: port}
+	}
+}
+
+func marshalPropertySet(props []Property) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteString(`<?xml version="1.0"?>` + "\n")
+	buf.WriteString(`<e:propertyset xmlns:e="urn:schemas-upnp-org:event-1-0">` + "\n")
+	for _, prop := range props {
+		if !validPropertyName(prop.Name) {
+			return nil, fmt.Errorf("invalid state variable name: %q", prop.Name)
+		}
+		fmt.Fprintf(&buf, "<e:property>\n<%s>", prop.Name)
+		xml.EscapeText(&buf, []byte(prop.Value))
+		fmt.Fprintf(&buf, "</%s>\n</e:property>\n", prop.Name)
+	}
+	buf.WriteString("</e:propertyset>\n")
+	return buf.Bytes(), nil
+}
+
+// validPropertyName reports whether s is usable as an unqualified
+// XML element name.
+func validPropertyName(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i, r := range s {
+		switch {
+		case r == '_', unicode.IsLetter(r):
+		case i > 0 && (r == '-' || r == '.' || unicode.IsDigit(r)):
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+func writeSubscription(w http.ResponseWriter, sid string, tmo time.Duration) {
+	h := w.Header()
+	h["SID"] = []string{sid}
+	h["TIMEOUT"] = []string{fmt.Sprintf("Second-%d", tmo/time.Second)}
+	h.Set("Content-Length", "0")
+	w.WriteHeader(http.StatusOK)
+}
+
+func parseCallback(s string) ([]*url.URL, error) {
+	var cbs []*url.URL
+	for {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			break
+		}
+		if s[0] != '<' {
+			return nil, fmt.Errorf("malformed callback: %v", s)
+		}
+		i := strings.IndexByte(s, '>')
+		if i < 0 {
+			return nil, fmt.Errorf("malformed callback: %v", s)
+		}
+		u, err := url.Parse(s[1:i])
+		if err != nil {
+			return nil, err
+		}
+		if u.Scheme != "http" {
+			return nil, fmt.Errorf("unknown callback scheme: %v", u.Scheme)
+		}
+		cbs = append(cbs, u)
+		s = s[i+1:]
+	}
+	if len(cbs) == 0 {
+		return nil, errors.New("no callback")
+	}
+	return cbs, nil
+}
+
+// nextSeq returns the next event sequence number. It wraps to 1, not
+// 0, after reaching the maximum value.
+func nextSeq(seq uint32) uint32 {
+	if seq == 1<<32-1 {
+		return 1
+	}
+	return seq + 1
+}
+
+func newSID() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	b[6] = b[6]&0x0f | 0x40 // version 4
+	b[8] = b[8]&0x3f | 0x80 // variant 10
+	return fmt.Sprintf("uuid:%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16]), nil
+}
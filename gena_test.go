@@ -0,0 +1,221 @@
+// Copyright 2014 Mikio Hara. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ssdp
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+type eventMessage struct {
+	sid, seq string
+	body     string
+}
+
+func TestEventPublisher(t *testing.T) {
+	evCh := make(chan eventMessage, 4)
+	sub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		b, _ := ioutil.ReadAll(req.Body)
+		evCh <- eventMessage{sid: req.Header.Get("Sid"), seq: req.Header.Get("Seq"), body: string(b)}
+	}))
+	defer sub.Close()
+	var pub EventPublisher
+	defer pub.Close()
+	pub.Publish([]Property{{Name: "Volume", Value: "10"}})
+	srv := httptest.NewServer(&pub)
+	defer srv.Close()
+
+	do := func(method string, hdr map[string]string) *http.Response {
+		req, err := http.NewRequest(method, srv.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for k, v := range hdr {
+			req.Header.Set(k, v)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+	recv := func(seq string) eventMessage {
+		select {
+		case ev := <-evCh:
+			if ev.seq != seq {
+				t.Fatalf("got %v; want %v", ev.seq, seq)
+			}
+			return ev
+		case <-time.After(3 * time.Second):
+			t.Fatalf("no event message for %v", seq)
+		}
+		return eventMessage{}
+	}
+
+	resp := do(subscribeMethod, map[string]string{"Callback": "<" + sub.URL + "/event>", "Nt": "upnp:event", "Timeout": "Second-60"})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got %v; want %v", resp.Status, http.StatusOK)
+	}
+	sid := resp.Header.Get("Sid")
+	if !strings.HasPrefix(sid, "uuid:") {
+		t.Fatalf("got %q; want uuid", sid)
+	}
+	if tmo := resp.Header.Get("Timeout"); tmo != "Second-60" {
+		t.Fatalf("got %v; want Second-60", tmo)
+	}
+	ev := recv("0")
+	if ev.sid != sid || !strings.Contains(ev.body, "<Volume>10</Volume>") {
+		t.Fatalf("unexpected initial event message: %+v", ev)
+	}
+	pub.Publish([]Property{{Name: "Volume", Value: "<11>"}})
+	if ev := recv("1"); !strings.Contains(ev.body, "<Volume>&lt;11&gt;</Volume>") {
+		t.Fatalf("unexpected event message: %+v", ev)
+	}
+
+	if resp := do(subscribeMethod, map[string]string{"Sid": sid, "Timeout": "Second-infinite"}); resp.StatusCode != http.StatusOK || resp.Header.Get("Timeout") != "Second-1800" {
+		t.Fatalf("unexpected renewal response: %v, %v", resp.Status, resp.Header)
+	}
+	if resp := do(subscribeMethod, map[string]string{"Sid": sid, "Nt": "upnp:event"}); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("got %v; want %v", resp.Status, http.StatusBadRequest)
+	}
+	if resp := do(subscribeMethod, map[string]string{"Callback": "<" + sub.URL + ">", "Nt": "upnp:propchange"}); resp.StatusCode != http.StatusPreconditionFailed {
+		t.Fatalf("got %v; want %v", resp.Status, http.StatusPreconditionFailed)
+	}
+	if resp := do(unsubscribeMethod, map[string]string{"Sid": sid}); resp.StatusCode != http.StatusOK {
+		t.Fatalf("got %v; want %v", resp.Status, http.StatusOK)
+	}
+	if resp := do(unsubscribeMethod, map[string]string{"Sid": sid}); resp.StatusCode != http.StatusPreconditionFailed {
+		t.Fatalf("got %v; want %v", resp.Status, http.StatusPreconditionFailed)
+	}
+}
+
+func TestEventPublisherExpire(t *testing.T) {
+	var pub EventPublisher
+	sub := &subscription{
+		sid:     "uuid:--",
+		expires: time.Now().Add(time.Hour),
+		timer:   time.NewTimer(time.Hour),
+		done:    make(chan struct{}),
+	}
+	pub.subs = map[string]*subscription{sub.sid: sub}
+
+	// The timer fired while a renewal extended the deadline.
+	pub.expire(sub.sid)
+	if _, ok := pub.subs[sub.sid]; !ok {
+		t.Fatal("renewed subscription expired")
+	}
+
+	sub.expires = time.Now()
+	pub.expire(sub.sid)
+	if _, ok := pub.subs[sub.sid]; ok {
+		t.Fatal("subscription not expired")
+	}
+	select {
+	case <-sub.done:
+	default:
+		t.Error("subscription not cancelled")
+	}
+}
+
+func TestNotifyEvent(t *testing.T) {
+	mifs, err := interfaces(nil, ipv4Unicast)
+	if err != nil || len(mifs) == 0 {
+		t.Skip("no available multicast network interface found")
+	}
+	c := &recordConn{}
+	dev := &Device{conn: c, group: &net.UDPAddr{IP: net.ParseIP(DefaultIPv4Group), Port: 1900}, unicast: ipv4Unicast}
+
+	var pub EventPublisher
+	hdr := make(http.Header)
+	hdr.Set("Usn", "uuid:--::urn:schemas-upnp-org:service:RenderingControl:1")
+	hdr.Set("Svcid", "urn:upnp-org:serviceId:RenderingControl")
+	hdr.Set("Bootid.upnp.org", "1")
+	for i := 0; i < 3; i++ {
+		if err := pub.PublishMulticast(dev, hdr, []Property{{Name: "Volume", Value: strconv.Itoa(i) + "<"}}, mifs[:1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := pub.PublishMulticast(dev, hdr, []Property{{Name: "Vol>ume", Value: "10"}}, mifs[:1]); err == nil {
+		t.Error("published invalid state variable name")
+	}
+
+	dgs := c.datagrams()
+	if len(dgs) != 3 {
+		t.Fatalf("got %d datagrams; want 3", len(dgs))
+	}
+	for i, dg := range dgs {
+		if dg.dst.String() != DefaultIPv4EventGroup+":"+DefaultEventPort {
+			t.Errorf("#%d: got %v; want %s:%s", i, dg.dst, DefaultIPv4EventGroup, DefaultEventPort)
+		}
+		req, err := parseAdvert(dg.b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body := dg.b[bytes.Index(dg.b, []byte("\r\n\r\n"))+4:]
+		want := "<?xml version=\"1.0\"?>\n<e:propertyset xmlns:e=\"urn:schemas-upnp-org:event-1-0\">\n<e:property>\n<Volume>" + strconv.Itoa(i) + "&lt;</Volume>\n</e:property>\n</e:propertyset>\n"
+		if seq := req.Header.Get("Seq"); seq != strconv.Itoa(i) {
+			t.Errorf("#%d: got %q; want %d", i, seq, i)
+		}
+		if req.Header.Get("Nt") != "upnp:event" || req.Header.Get("Nts") != "upnp:propchange" || req.Header.Get("Lvl") != "upnp:/info" || req.Header.Get("Content-Length") != strconv.Itoa(len(want)) {
+			t.Errorf("#%d: unexpected header: %v", i, req.Header)
+		}
+		if string(body) != want {
+			t.Errorf("#%d: got %q; want %q", i, body, want)
+		}
+	}
+}
+
+func TestEventPublisherInitialEvent(t *testing.T) {
+	evCh := make(chan eventMessage, 4)
+	sub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		b, _ := ioutil.ReadAll(req.Body)
+		evCh <- eventMessage{sid: req.Header.Get("Sid"), seq: req.Header.Get("Seq"), body: string(b)}
+	}))
+	defer sub.Close()
+	var pub EventPublisher
+	defer pub.Close()
+	if err := pub.Publish([]Property{{Name: "1Volume", Value: "10"}}); err == nil {
+		t.Error("published invalid state variable name")
+	}
+	pub.Publish([]Property{{Name: "Volume", Value: "10"}})
+	req, err := http.NewRequest(subscribeMethod, "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Callback", "<"+sub.URL+"/event>")
+	req.Header.Set("Nt", "upnp:event")
+	pub.ServeHTTP(&publishingRecorder{ResponseRecorder: httptest.NewRecorder(), pub: &pub}, req)
+
+	for i, want := range []string{"<Volume>10</Volume>", "<Volume>11</Volume>"} {
+		select {
+		case ev := <-evCh:
+			if ev.seq != strconv.Itoa(i) || !strings.Contains(ev.body, want) {
+				t.Fatalf("got %v, %q; want %d, %q", ev.seq, ev.body, i, want)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatalf("no event message for %d", i)
+		}
+	}
+}
+
+// A publishingRecorder publishes an event while writing the
+// subscription response.
+type publishingRecorder struct {
+	*httptest.ResponseRecorder
+	pub *EventPublisher
+}
+
+func (rw *publishingRecorder) WriteHeader(code int) {
+	rw.pub.Publish([]Property{{Name: "Volume", Value: "11"}})
+	rw.ResponseRecorder.WriteHeader(code)
+}
@@ -0,0 +1,273 @@
+// Copyright 2014 Mikio Hara. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ssdp
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// A HeaderField represents a SSDP header field.
+type HeaderField struct {
+	Name  string // field name as is on the wire
+	Value string
+}
+
+// A Header represents an ordered, case-preserving SSDP header. The
+// fields are written on the wire in order, with the names as they
+// are.
+type Header []HeaderField
+
+// conventionalFields holds the field names in the casing and order
+// used in the examples of UPnP Device Architecture 1.1.
+var conventionalFields = []string{
+	"HOST",
+	"CACHE-CONTROL",
+	"DATE",
+	"EXT",
+	"LOCATION",
+	"MAN",
+	"MX",
+	"NT",
+	"NTS",
+	"SERVER",
+	"ST",
+	"USER-AGENT",
+	"USN",
+	"BOOTID.UPNP.ORG",
+	"CONFIGID.UPNP.ORG",
+	"SEARCHPORT.UPNP.ORG",
+	"NEXTBOOTID.UPNP.ORG",
+	"SECURELOCATION.UPNP.ORG",
+	"CPFN.UPNP.ORG",
+	"CPUUID.UPNP.ORG",
+	"TCPPORT.UPNP.ORG",
+}
+
+var conventionalRanks = func() map[string]int {
+	m := make(map[string]int)
+	for i, name := range conventionalFields {
+		m[http.CanonicalHeaderKey(name)] = i
+	}
+	return m
+}()
+
+// HeaderFromHTTP returns the header converted from hdr. Well-known
+// SSDP fields are named in upper case and placed in the conventional
+// order, followed by the other fields in alphabetical order. A key of
+// hdr not in the canonical form is used as the field name as is.
+func HeaderFromHTTP(hdr http.Header) Header {
+	type key struct {
+		key   string // key of hdr
+		name  string
+		canon string
+		rank  int
+	}
+	keys := make([]key, 0, len(hdr))
+	for k := range hdr {
+		canon := http.CanonicalHeaderKey(k)
+		rank, ok := conventionalRanks[canon]
+		if !ok {
+			rank = len(conventionalFields)
+		}
+		name := k
+		if ok && k == canon {
+			name = conventionalFields[rank]
+		}
+		keys = append(keys, key{key: k, name: name, canon: canon, rank: rank})
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].rank != keys[j].rank {
+			return keys[i].rank < keys[j].rank
+		}
+		return keys[i].canon < keys[j].canon
+	})
+	h := make(Header, 0, len(keys))
+	for _, k := range keys {
+		for _, v := range hdr[k.key] {
+			h = append(h, HeaderField{Name: k.name, Value: v})
+		}
+	}
+	return h
+}
+
+// headerAsIs returns the header converted from hdr with the keys of
+// hdr as the field names, in the order http.Header.Write uses.
+func headerAsIs(hdr http.Header) Header {
+	keys := make([]string, 0, len(hdr))
+	for k := range hdr {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var h Header
+	for _, k := range keys {
+		for _, v := range hdr[k] {
+			h = append(h, HeaderField{Name: k, Value: v})
+		}
+	}
+	return h
+}
+
+// HTTPHeader returns the header converted to http.Header.
+func (h Header) HTTPHeader() http.Header {
+	hdr := make(http.Header, len(h))
+	for _, f := range h {
+		hdr.Add(f.Name, f.Value)
+	}
+	return hdr
+}
+
+// Get returns the first value associated with the name. The name is
+// case-insensitive.
+func (h Header) Get(name string) string {
+	for _, f := range h {
+		if strings.EqualFold(f.Name, name) {
+			return f.Value
+		}
+	}
+	return ""
+}
+
+// Set replaces the value of the first field associated with the
+// name, keeping its position and casing, and removes the other
+// fields associated with the name. If there is no such field, it
+// appends a new field.
+func (h *Header) Set(name, value string) {
+	out := (*h)[:0]
+	found := false
+	for _, f := range *h {
+		if strings.EqualFold(f.Name, name) {
+			if found {
+				continue
+			}
+			found = true
+			f.Value = value
+		}
+		out = append(out, f)
+	}
+	if !found {
+		out = append(out, HeaderField{Name: name, Value: value})
+	}
+	*h = out
+}
+
+// Add appends a new field.
+func (h *Header) Add(name, value string) {
+	*h = append(*h, HeaderField{Name: name, Value: value})
+}
+
+// Del removes the fields associated with the name.
+func (h *Header) Del(name string) {
+	out := (*h)[:0]
+	for _, f := range *h {
+		if !strings.EqualFold(f.Name, name) {
+			out = append(out, f)
+		}
+	}
+	*h = out
+}
+
+var headerValueReplacer = strings.NewReplacer("\r\n", " ", "\r", " ", "\n", " ")
+
+// Write writes the header fields in order. It fails without writing
+// anything when a field name is not a valid token.
+func (h Header) Write(w io.Writer) error {
+	for _, f := range h {
+		if !validFieldNameString(f.Name) {
+			return fmt.Errorf("invalid header field name: %q", f.Name)
+		}
+	}
+	var buf bytes.Buffer
+	for _, f := range h {
+		buf.WriteString(f.Name)
+		buf.WriteByte(':')
+		if f.Value != "" {
+			buf.WriteByte(' ')
+			buf.WriteString(headerValueReplacer.Replace(f.Value))
+		}
+		buf.WriteString("\r\n")
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// merge returns the header that reflects hdr onto the order and
+// casing of h. Fields of h missing from hdr are removed and fields of
+// hdr missing from h are appended in the conventional order. When
+// host is not empty, it becomes the value of HOST field.
+func (h Header) merge(hdr http.Header, host string) Header {
+	vals := make(map[string][]string, len(hdr))
+	for k, vs := range hdr {
+		canon := http.CanonicalHeaderKey(k)
+		vals[canon] = append(vals[canon], vs...)
+	}
+	out := make(Header, 0, len(h)+len(hdr)+1)
+	done := make(map[string]bool)
+	hostDone := host == ""
+	for _, f := range h {
+		k := http.CanonicalHeaderKey(f.Name)
+		if k == "Host" {
+			if !hostDone {
+				out = append(out, HeaderField{Name: f.Name, Value: host})
+				hostDone = true
+			}
+			continue
+		}
+		if done[k] {
+			continue
+		}
+		done[k] = true
+		for _, v := range vals[k] {
+			out = append(out, HeaderField{Name: f.Name, Value: v})
+		}
+	}
+	if !hostDone {
+		out = append(Header{{Name: "HOST", Value: host}}, out...)
+	}
+	rest := make(http.Header)
+	for k, vs := range hdr {
+		if !done[http.CanonicalHeaderKey(k)] && http.CanonicalHeaderKey(k) != "Host" {
+			rest[k] = vs
+		}
+	}
+	return append(out, HeaderFromHTTP(rest)...)
+}
+
+// parseHeader returns the header fields of the message b as they
+// are.
+func parseHeader(b []byte) Header {
+	var h Header
+	first := true
+	for len(b) > 0 {
+		var l []byte
+		if i := bytes.IndexByte(b, '\n'); i >= 0 {
+			l, b = b[:i], b[i+1:]
+		} else {
+			l, b = b, nil
+		}
+		l = bytes.TrimSuffix(l, []byte("\r"))
+		if first {
+			first = false
+			continue
+		}
+		if len(l) == 0 {
+			break
+		}
+		if (l[0] == ' ' || l[0] == '\t') && len(h) > 0 {
+			h[len(h)-1].Value += " " + string(bytes.TrimSpace(l))
+			continue
+		}
+		i := bytes.IndexByte(l, ':')
+		if i < 0 {
+			continue
+		}
+		h = append(h, HeaderField{Name: string(bytes.TrimSpace(l[:i])), Value: string(bytes.TrimSpace(l[i+1:]))})
+	}
+	return h
+}
@@ -0,0 +1,120 @@
+// Copyright 2014 Mikio Hara. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ssdp
+
+import (
+	"bytes"
+	"net"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestHeaderFromHTTP(t *testing.T) {
+	hdr := make(http.Header)
+	hdr.Set("Usn", "uuid:--::upnp:rootdevice")
+	hdr.Set("X-Vendor", "test")
+	hdr.Set("Nts", "ssdp:alive")
+	hdr.Set("Bootid.upnp.org", "1")
+	hdr.Set("Nt", "upnp:rootdevice")
+	hdr.Set("Location", "http://192.0.2.1/dd.xml")
+	hdr.Set("Cache-Control", "max-age=1800")
+	hdr.Set("Server", "OS/1 UPnP/1.1 test/1")
+	hdr["myheader.example.com"] = []string{"as is"}
+	var buf bytes.Buffer
+	if err := HeaderFromHTTP(hdr).Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	want := "CACHE-CONTROL: max-age=1800\r\n" +
+		"LOCATION: http://192.0.2.1/dd.xml\r\n" +
+		"NT: upnp:rootdevice\r\n" +
+		"NTS: ssdp:alive\r\n" +
+		"SERVER: OS/1 UPnP/1.1 test/1\r\n" +
+		"USN: uuid:--::upnp:rootdevice\r\n" +
+		"BOOTID.UPNP.ORG: 1\r\n" +
+		"myheader.example.com: as is\r\n" +
+		"X-Vendor: test\r\n"
+	if buf.String() != want {
+		t.Errorf("got %q; want %q", buf.String(), want)
+	}
+}
+
+func TestHeader(t *testing.T) {
+	h := Header{{"St", "ssdp:all"}, {"mx", "1"}, {"MX", "2"}}
+	h.Set("MX", "3")
+	h.Add("EXT", "")
+	h.Set("Man", `"ssdp:discover"`)
+	want := Header{{"St", "ssdp:all"}, {"mx", "3"}, {"EXT", ""}, {"Man", `"ssdp:discover"`}}
+	if !reflect.DeepEqual(h, want) {
+		t.Errorf("got %v; want %v", h, want)
+	}
+	if v := h.Get("st"); v != "ssdp:all" {
+		t.Errorf("got %q; want ssdp:all", v)
+	}
+	h.Del("st")
+	var buf bytes.Buffer
+	h.Write(&buf)
+	if buf.String() != "mx: 3\r\nEXT:\r\nMan: \"ssdp:discover\"\r\n" {
+		t.Errorf("unexpected header: %q", buf.String())
+	}
+	if hdr := h.HTTPHeader(); hdr.Get("Mx") != "3" || len(hdr) != 3 {
+		t.Errorf("unexpected http header: %v", hdr)
+	}
+}
+
+func TestHeaderWriteInvalidName(t *testing.T) {
+	for _, name := range []string{"", "X\r\nInjected", "X:Y", "X\n"} {
+		h := Header{{"Nt", "upnp:rootdevice"}, {name, "v"}}
+		var buf bytes.Buffer
+		if err := h.Write(&buf); err == nil || buf.Len() != 0 {
+			t.Errorf("%q: got %v, %q; want error and no output", name, err, buf.String())
+		}
+	}
+	req := &http.Request{Method: notifyMethod, Host: "239.255.255.250:1900", Header: http.Header{"X\r\nInjected": {"v"}}}
+	var buf bytes.Buffer
+	if err := marshalOrderedAdvert(&buf, req, nil); err == nil {
+		t.Errorf("got %q; want error", buf.String())
+	}
+}
+
+func TestAdvertRedirectorHeaderOrder(t *testing.T) {
+	raw := []byte("NOTIFY * HTTP/1.1\r\n" +
+		"Host:239.255.255.250:1900\r\n" +
+		"nt: upnp:rootdevice\r\n" +
+		"Nts: ssdp:alive\r\n" +
+		"server: test\r\n" +
+		"USN: uuid:--::upnp:rootdevice\r\n" +
+		"Cache-Control: max-age=1800\r\n" +
+		"\r\n")
+	req, err := parseAdvert(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &recordConn{}
+	grp := &net.UDPAddr{IP: net.ParseIP(DefaultIPv4Group), Port: 1900}
+	p := &path{src: &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1900}, dst: &net.UDPAddr{IP: grp.IP}}
+	rdr := newAdvertRedirector(c, nil, grp, p, req)
+	rdr.raw = raw
+	rdr.Header().Del("Server")
+	rdr.Header().Set("Location", "http://192.0.2.1/dd.xml")
+	if _, err := rdr.WriteTo(grp, nil); err != nil {
+		t.Fatal(err)
+	}
+	want := "NOTIFY * HTTP/1.1\r\n" +
+		"Host: 239.255.255.250:1900\r\n" +
+		"nt: upnp:rootdevice\r\n" +
+		"Nts: ssdp:alive\r\n" +
+		"USN: uuid:--::upnp:rootdevice\r\n" +
+		"Cache-Control: max-age=1800\r\n" +
+		"LOCATION: http://192.0.2.1/dd.xml\r\n" +
+		"\r\n"
+	dgs := c.datagrams()
+	if len(dgs) != 1 {
+		t.Fatalf("got %d datagrams; want 1", len(dgs))
+	}
+	if string(dgs[0].b) != want {
+		t.Errorf("got %q; want %q", dgs[0].b, want)
+	}
+}
@@ -4,7 +4,11 @@
 
 package ssdp
 
-import "net"
+import (
+	"errors"
+	"net"
+	"sync"
+)
 
 var (
 	supportsIPv4 bool
@@ -35,3 +39,62 @@ func loopbackInterface() *net.Interface {
 	}
 	return nil
 }
+
+type datagram struct {
+	b   []byte
+	dst *net.UDPAddr
+	ifi *net.Interface
+}
+
+// A recordConn records outbound datagrams.
+type recordConn struct {
+	sync.Mutex
+	dgs []datagram
+}
+
+func (c *recordConn) Close() error                              { return nil }
+func (c *recordConn) JoinGroup(*net.Interface, net.Addr) error  { return nil }
+func (c *recordConn) LeaveGroup(*net.Interface, net.Addr) error { return nil }
+func (c *recordConn) SetMulticastLoopback(bool) error           { return nil }
+func (c *recordConn) setControlFlags() error                    { return nil }
+
+func (c *recordConn) SetMulticastInterface(*net.Interface) error { return nil }
+
+func (c *recordConn) readFrom([]byte) (int, *path, error) {
+	return 0, nil, errors.New("not implemented")
+}
+
+func (c *recordConn) writeTo(b []byte, dst *net.UDPAddr, ifi *net.Interface) (int, error) {
+	c.Lock()
+	defer c.Unlock()
+	c.dgs = append(c.dgs, datagram{b: append([]byte(nil), b...), dst: dst, ifi: ifi})
+	return len(b), nil
+}
+
+func (c *recordConn) readBatch([]inMessage) (int, error) {
+	return 0, errors.New("not implemented")
+}
+
+func (c *recordConn) writeBatch(oms []outMessage) ([]writeResult, error) {
+	rs := make([]writeResult, len(oms))
+	for i := range oms {
+		rs[i] = oms[i].result()
+		rs[i].n, rs[i].err = c.writeTo(oms[i].b, oms[i].dst, oms[i].ifi)
+	}
+	return rs, nil
+}
+
+func (c *recordConn) writeToMulti(b []byte, grp *net.UDPAddr, mifs []net.Interface) ([]writeResult, error) {
+	var rs []writeResult
+	for i := range mifs {
+		n, err := c.writeTo(b, grp, &mifs[i])
+		rs = append(rs, writeResult{ifi: mifs[i], n: n, err: err})
+	}
+	return rs, nil
+}
+
+func (c *recordConn) datagrams() []datagram {
+	c.Lock()
+	defer c.Unlock()
+	return append([]datagram(nil), c.dgs...)
+}
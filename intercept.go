@@ -0,0 +1,210 @@
+// Copyright 2014 Mikio Hara. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ssdp
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+)
+
+// A Packet represents a SSDP message going through interceptors.
+type Packet struct {
+	// Data holds the message. An interceptor may replace it but
+	// must not modify the bytes of outbound message in place. An
+	// inbound message longer than the receive buffer of the
+	// endpoint is dropped and reported as a read failure.
+	Data []byte
+
+	Outbound bool         // whether the message is outbound
+	Src      *net.UDPAddr // source address of inbound message
+	Dst      *net.UDPAddr // destination address
+
+	// IfIndex specifies the inbound or outbound network interface
+	// index. It is zero when unknown.
+	IfIndex int
+}
+
+// Request parses the message as a NOTIFY or M-SEARCH message.
+func (p *Packet) Request() (*http.Request, error) {
+	return parseAdvert(p.Data)
+}
+
+// Response parses the message as a response message.
+func (p *Packet) Response() (*http.Response, error) {
+	return parseResponse(p.Data)
+}
+
+// SetRequest replaces the message with the NOTIFY or M-SEARCH
+// message req.
+func (p *Packet) SetRequest(req *http.Request) error {
+	var buf bytes.Buffer
+	if err := marshalAdvert(&buf, req); err != nil {
+		return err
+	}
+	p.Data = buf.Bytes()
+	return nil
+}
+
+// SetResponse replaces the message with the response message resp.
+func (p *Packet) SetResponse(resp *http.Response) error {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%s %s\r\n", resp.Proto, resp.Status)
+	if err := HeaderFromHTTP(resp.Header).Write(&buf); err != nil {
+		return err
+	}
+	buf.WriteString("\r\n")
+	if resp.Body != nil {
+		b, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+		buf.Write(b)
+	}
+	p.Data = buf.Bytes()
+	return nil
+}
+
+// An Interceptor intercepts inbound and outbound SSDP messages of the
+// endpoints created by Listener. It may modify the packet. It returns
+// false to drop the packet. Dropping an outbound packet is not
+// reported as a write failure.
+type Interceptor func(*Packet) bool
+
+// A tooLongError reports an inbound message replaced by interceptors
+// with one longer than the receive buffer. It is temporary as the
+// endpoint keeps reading.
+type tooLongError struct {
+	src    *net.UDPAddr // source address
+	n, max int          // message length and buffer length
+}
+
+func (e *tooLongError) Error() string {
+	return fmt.Sprintf("intercepted message from %v dropped: %d bytes exceed %d-byte buffer", e.src, e.n, e.max)
+}
+
+func (e *tooLongError) Timeout() bool   { return false }
+func (e *tooLongError) Temporary() bool { return true }
+
+// An interceptConn represents a network connection endpoint that
+// applies a chain of interceptors.
+type interceptConn struct {
+	conn
+	chain []Interceptor
+	err   error // read failure pending until the next batch read
+}
+
+func (c *interceptConn) intercept(p *Packet) bool {
+	for _, icpt := range c.chain {
+		if !icpt(p) {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *interceptConn) readFrom(b []byte) (int, *path, error) {
+	for {
+		n, path, err := c.conn.readFrom(b)
+		if err != nil {
+			return n, path, err
+		}
+		p := Packet{Data: b[:n], Src: path.src, Dst: path.dst, IfIndex: path.ifIndex}
+		if !c.intercept(&p) {
+			continue
+		}
+		if len(p.Data) > len(b) {
+			return 0, path, &tooLongError{src: path.src, n: len(p.Data), max: len(b)}
+		}
+		return copy(b, p.Data), path, nil
+	}
+}
+
+func (c *interceptConn) readBatch(ims []inMessage) (int, error) {
+	if err := c.err; err != nil {
+		c.err = nil
+		return 0, err
+	}
+	for {
+		n, err := c.conn.readBatch(ims)
+		if err != nil {
+			return n, err
+		}
+		k := 0
+		for i := 0; i < n; i++ {
+			im := &ims[i]
+			p := Packet{Data: im.b[:im.n], Src: im.path.src, Dst: im.path.dst, IfIndex: im.path.ifIndex}
+			if !c.intercept(&p) {
+				continue
+			}
+			if len(p.Data) > len(im.b) {
+				if c.err == nil {
+					c.err = &tooLongError{src: im.path.src, n: len(p.Data), max: len(im.b)}
+				}
+				continue
+			}
+			im.n = copy(im.b, p.Data)
+			ims[k], ims[i] = ims[i], ims[k]
+			k++
+		}
+		if k > 0 {
+			return k, nil
+		}
+		if err := c.err; err != nil {
+			c.err = nil
+			return 0, err
+		}
+	}
+}
+
+func (c *interceptConn) writeTo(b []byte, dst *net.UDPAddr, ifi *net.Interface) (int, error) {
+	p := Packet{Data: b, Outbound: true, Dst: dst}
+	if ifi != nil && dst.IP.IsMulticast() {
+		p.IfIndex = ifi.Index
+	}
+	if !c.intercept(&p) {
+		return len(b), nil
+	}
+	return c.conn.writeTo(p.Data, dst, ifi)
+}
+
+func (c *interceptConn) writeBatch(oms []outMessage) ([]writeResult, error) {
+	rs := make([]writeResult, len(oms))
+	pass := make([]outMessage, 0, len(oms))
+	idx := make([]int, 0, len(oms))
+	for i, om := range oms {
+		rs[i] = om.result()
+		p := Packet{Data: om.b, Outbound: true, Dst: om.dst}
+		if om.ifi != nil && om.dst.IP.IsMulticast() {
+			p.IfIndex = om.ifi.Index
+		}
+		if !c.intercept(&p) {
+			rs[i].n = len(om.b)
+			continue
+		}
+		om.b = p.Data
+		pass = append(pass, om)
+		idx = append(idx, i)
+	}
+	prs, _ := c.conn.writeBatch(pass)
+	for i, r := range prs {
+		rs[idx[i]].n, rs[idx[i]].err = r.n, r.err
+	}
+	return rs, lastWriteError(rs)
+}
+
+func (c *interceptConn) writeToMulti(b []byte, grp *net.UDPAddr, mifs []net.Interface) ([]writeResult, error) {
+	if len(b) == 0 { // to prevent writing malformed packets on some platforms
+		return nil, nil
+	}
+	oms := make([]outMessage, len(mifs))
+	for i := range mifs {
+		oms[i] = outMessage{b: b, dst: grp, ifi: &mifs[i]}
+	}
+	return c.writeBatch(oms)
+}
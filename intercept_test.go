@@ -0,0 +1,167 @@
+// Copyright 2014 Mikio Hara. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ssdp
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestInterceptConnOutbound(t *testing.T) {
+	rc := &recordConn{}
+	var seen []int
+	c := &interceptConn{conn: rc, chain: []Interceptor{
+		func(p *Packet) bool {
+			seen = append(seen, p.IfIndex)
+			return p.IfIndex != 2
+		},
+		func(p *Packet) bool {
+			req, err := p.Request()
+			if err != nil {
+				t.Error(err)
+				return false
+			}
+			req.Header.Set("X-Vendor", "test")
+			if err := p.SetRequest(req); err != nil {
+				t.Error(err)
+				return false
+			}
+			return true
+		},
+	}}
+	grp := &net.UDPAddr{IP: net.ParseIP(DefaultIPv4Group), Port: 1900}
+	mifs := []net.Interface{{Index: 1, Name: "eth0"}, {Index: 2, Name: "eth1"}, {Index: 3, Name: "eth2"}}
+	b := []byte("NOTIFY * HTTP/1.1\r\nHost: 239.255.255.250:1900\r\nNt: upnp:rootdevice\r\nNts: ssdp:alive\r\n\r\n")
+	orig := append([]byte(nil), b...)
+	rs, err := c.writeToMulti(b, grp, mifs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rs) != 3 || len(seen) != 3 {
+		t.Fatalf("got %d results, %d calls; want 3, 3", len(rs), len(seen))
+	}
+	if !bytes.Equal(b, orig) {
+		t.Errorf("outbound message modified in place: %q", b)
+	}
+	dgs := rc.datagrams()
+	if len(dgs) != 2 || dgs[0].ifi.Name != "eth0" || dgs[1].ifi.Name != "eth2" {
+		t.Fatalf("unexpected datagrams: %+v", dgs)
+	}
+	for _, dg := range dgs {
+		if !bytes.Contains(dg.b, []byte("X-Vendor: test\r\n")) {
+			t.Errorf("header not injected: %q", dg.b)
+		}
+	}
+
+	seen = nil
+	if n, err := c.writeTo(b, grp, &mifs[1]); err != nil || n != len(b) {
+		t.Fatalf("got %d, %v; want %d, nil", n, err, len(b))
+	}
+	if len(seen) != 1 || seen[0] != 2 || len(rc.datagrams()) != 2 {
+		t.Fatalf("vetoed message written: %v, %+v", seen, rc.datagrams())
+	}
+}
+
+func TestInterceptorInbound(t *testing.T) {
+	drop := func(p *Packet) bool {
+		req, err := p.Request()
+		return err == nil && req.Header.Get("Usn") != "uuid:drop"
+	}
+	tag := func(p *Packet) bool {
+		if p.Outbound || p.Src == nil {
+			t.Errorf("unexpected inbound packet: %+v", p)
+		}
+		p.Data = bytes.Replace(p.Data, []byte("\r\n\r\n"), []byte("\r\nX-Tagged: yes\r\n\r\n"), 1)
+		return true
+	}
+	cpln := Listener{Port: "1911", LocalPort: "1911", Interceptors: []Interceptor{drop, tag}}
+	cp, err := cpln.ListenControlPoint(nil)
+	if err != nil {
+		t.Skip(err)
+	}
+	defer cp.Close()
+	ch := make(chan *http.Request, 4)
+	go cp.Serve(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) { ch <- req }))
+
+	devln := Listener{Port: "1911", LocalPort: "1912", MulticastLoopback: true}
+	dev, err := devln.ListenDevice(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dev.Close()
+	for _, usn := range []string{"uuid:drop", "uuid:pass"} {
+		hdr := make(http.Header)
+		hdr.Set("Nt", "upnp:rootdevice")
+		hdr.Set("Nts", "ssdp:alive")
+		hdr.Set("Usn", usn)
+		if err := dev.Notify(hdr, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	select {
+	case req := <-ch:
+		if req.Header.Get("Usn") != "uuid:pass" || req.Header.Get("X-Tagged") != "yes" {
+			t.Errorf("unexpected message: %v", req.Header)
+		}
+	case <-time.After(time.Second):
+		t.Skip("no message received")
+	}
+}
+
+// A batchConn returns the inbound messages of msgs in a single batch.
+type batchConn struct {
+	recordConn
+	msgs []string
+}
+
+func (c *batchConn) readBatch(ims []inMessage) (int, error) {
+	if len(c.msgs) == 0 {
+		return 0, errors.New("no more messages")
+	}
+	n := len(c.msgs)
+	if n > len(ims) {
+		n = len(ims)
+	}
+	for i, msg := range c.msgs[:n] {
+		ims[i].n = copy(ims[i].b, msg)
+		ims[i].path = &path{src: &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1900}, dst: &net.UDPAddr{IP: net.ParseIP(DefaultIPv4Group), Port: 1900}}
+	}
+	c.msgs = c.msgs[n:]
+	return n, nil
+}
+
+func TestInterceptorInboundTooLong(t *testing.T) {
+	grow := func(p *Packet) bool {
+		if bytes.HasPrefix(p.Data, []byte("grow")) {
+			p.Data = bytes.Repeat([]byte{'a'}, 64)
+		}
+		return true
+	}
+	c := &interceptConn{conn: &batchConn{msgs: []string{"grow", "pass", "grow"}}, chain: []Interceptor{grow}}
+	ims := make([]inMessage, 4)
+	for i := range ims {
+		ims[i].b = make([]byte, 32)
+	}
+	n, err := c.readBatch(ims)
+	if err != nil || n != 1 || string(ims[0].b[:ims[0].n]) != "pass" {
+		t.Fatalf("got %d, %v; want 1, nil", n, err)
+	}
+	n, err = c.readBatch(ims)
+	if nerr, ok := err.(net.Error); !ok || !nerr.Temporary() || n != 0 {
+		t.Fatalf("got %d, %v; want 0, temporary error", n, err)
+	}
+	if _, err := c.readBatch(ims); err == nil || err.Error() != "no more messages" {
+		t.Fatalf("got %v; want underlying error", err)
+	}
+
+	c.conn = &batchConn{msgs: []string{"grow"}}
+	if n, err := c.readBatch(ims); n != 0 || err == nil || !err.(net.Error).Temporary() {
+		t.Fatalf("got %d, %v; want 0, temporary error", n, err)
+	}
+}
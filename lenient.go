@@ -0,0 +1,283 @@
+// Copyright 2014 Mikio Hara. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ssdp
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// A ParseMode represents a strictness level of parsing inbound SSDP
+// messages.
+type ParseMode int
+
+const (
+	// ParseStrict rejects messages that don't conform to the
+	// protocol.
+	ParseStrict ParseMode = iota
+
+	// ParseLenient normalizes common deviations from the protocol
+	// and records them.
+	ParseLenient
+)
+
+// A Deviation represents a deviation from the protocol found in an
+// inbound SSDP message parsed in ParseLenient mode.
+type Deviation string
+
+const (
+	DeviationBareLF          Deviation = "bare-lf"          // lines terminated by LF only
+	DeviationStartLine       Deviation = "start-line"       // extra whitespace or lower case method in start line
+	DeviationVersion         Deviation = "version"          // missing or unexpected protocol version
+	DeviationReasonPhrase    Deviation = "reason-phrase"    // missing reason phrase in status line
+	DeviationMalformedHeader Deviation = "malformed-header" // header line without colon, dropped
+	DeviationHeaderSpace     Deviation = "header-space"     // whitespace around header field name
+	DeviationFoldedHeader    Deviation = "folded-header"    // header value continued on the next line
+	DeviationDuplicateHeader Deviation = "duplicate-header" // repeated header field, the first one is used
+	DeviationUnterminated    Deviation = "unterminated"     // missing empty line after header
+	DeviationContentLength   Deviation = "content-length"   // content length different from body
+	DeviationTrailingGarbage Deviation = "trailing-garbage" // bytes after message, dropped
+)
+
+type deviationsKey struct{}
+
+// DeviationsFromContext returns the deviations found in the inbound
+// SSDP message of the request context ctx. It returns nil when the
+// message conforms to the protocol or is parsed in ParseStrict mode.
+// The deviations found in a response returned by ControlPoint.MSearch
+// are reported by DeviationsFromResponse.
+func DeviationsFromContext(ctx context.Context) []Deviation {
+	devs, _ := ctx.Value(deviationsKey{}).([]Deviation)
+	return devs
+}
+
+// DeviationsFromResponse returns the deviations found in the response
+// resp returned by ControlPoint.MSearch. It returns nil when the
+// response conforms to the protocol, is parsed in ParseStrict mode or
+// its Body has been replaced.
+func DeviationsFromResponse(resp *http.Response) []Deviation {
+	if b, ok := resp.Body.(*deviantBody); ok {
+		return b.devs
+	}
+	return nil
+}
+
+// A deviantBody is the body of a response carrying the deviations
+// found in the response.
+type deviantBody struct {
+	io.ReadCloser
+	devs []Deviation
+}
+
+// withResponseDeviations sets the deviations devs to resp.
+func withResponseDeviations(resp *http.Response, devs []Deviation) {
+	if devs != nil {
+		resp.Body = &deviantBody{ReadCloser: resp.Body, devs: devs}
+	}
+}
+
+// withDeviations returns a shallow copy of req carrying the
+// deviations devs, or req itself when there are none.
+func withDeviations(req *http.Request, devs []Deviation) *http.Request {
+	if devs == nil {
+		return req
+	}
+	return req.WithContext(context.WithValue(req.Context(), deviationsKey{}, devs))
+}
+
+// parseMode parses the message b in the mode. In the lenient mode
+// the message refers to a normalized copy of b.
+func (m *message) parseMode(b []byte, response bool, mode ParseMode) ([]Deviation, error) {
+	if mode != ParseLenient {
+		return nil, m.parse(b, response)
+	}
+	b, devs := normalize(b, response)
+	return devs, m.parse(b, response)
+}
+
+type deviations []Deviation
+
+func (devs *deviations) add(dev Deviation) {
+	for _, d := range *devs {
+		if d == dev {
+			return
+		}
+	}
+	*devs = append(*devs, dev)
+}
+
+// normalize returns the message b with the deviations from the
+// protocol fixed.
+func normalize(b []byte, response bool) ([]byte, []Deviation) {
+	var devs deviations
+	var buf bytes.Buffer
+	buf.Grow(len(b) + 32)
+
+	line := func() ([]byte, bool) {
+		if len(b) == 0 {
+			return nil, false
+		}
+		i := bytes.IndexByte(b, '\n')
+		if i < 0 {
+			l := b
+			b = nil
+			return bytes.TrimSuffix(l, []byte("\r")), true
+		}
+		l := b[:i]
+		b = b[i+1:]
+		if len(l) > 0 && l[len(l)-1] == '\r' {
+			return l[:len(l)-1], true
+		}
+		devs.add(DeviationBareLF)
+		return l, true
+	}
+
+	l, _ := line()
+	buf.WriteString(normalizeStartLine(string(l), response, &devs))
+	buf.WriteString("\r\n")
+
+	type field struct{ name, value string }
+	var fields []field
+	seen := make(map[string]bool)
+	terminated := false
+	for {
+		l, ok := line()
+		if !ok {
+			break
+		}
+		if len(bytes.TrimSpace(l)) == 0 {
+			terminated = true
+			break
+		}
+		if l[0] == ' ' || l[0] == '\t' {
+			devs.add(DeviationFoldedHeader)
+			if len(fields) > 0 {
+				f := &fields[len(fields)-1]
+				f.value = strings.TrimSpace(f.value + " " + string(bytes.TrimSpace(l)))
+			}
+			continue
+		}
+		i := bytes.IndexByte(l, ':')
+		if i < 0 {
+			devs.add(DeviationMalformedHeader)
+			continue
+		}
+		name := string(l[:i])
+		if tn := strings.TrimSpace(name); tn != name {
+			devs.add(DeviationHeaderSpace)
+			name = tn
+		}
+		if name == "" || strings.ContainsAny(name, " \t") {
+			devs.add(DeviationMalformedHeader)
+			continue
+		}
+		canon := http.CanonicalHeaderKey(name)
+		if seen[canon] {
+			devs.add(DeviationDuplicateHeader)
+			continue
+		}
+		seen[canon] = true
+		fields = append(fields, field{name: name, value: string(bytes.TrimSpace(l[i+1:]))})
+	}
+	if !terminated {
+		devs.add(DeviationUnterminated)
+	}
+
+	body := b
+	cl := -1
+	for i := range fields {
+		if http.CanonicalHeaderKey(fields[i].name) != "Content-Length" {
+			continue
+		}
+		n, err := strconv.Atoi(fields[i].value)
+		if err != nil || n < 0 || n > len(body) {
+			devs.add(DeviationContentLength)
+			fields[i].value = strconv.Itoa(len(body))
+			n = len(body)
+		}
+		cl = n
+	}
+	switch {
+	case cl >= 0 && cl < len(body):
+		devs.add(DeviationTrailingGarbage)
+		body = body[:cl]
+	case cl < 0 && len(body) > 0:
+		devs.add(DeviationTrailingGarbage)
+		body = nil
+	}
+	for _, f := range fields {
+		buf.WriteString(f.name)
+		buf.WriteString(": ")
+		buf.WriteString(f.value)
+		buf.WriteString("\r\n")
+	}
+	buf.WriteString("\r\n")
+	buf.Write(body)
+	if len(devs) == 0 {
+		return buf.Bytes(), nil
+	}
+	return buf.Bytes(), devs
+}
+
+func normalizeStartLine(l string, response bool, devs *deviations) string {
+	ss := strings.Fields(l)
+	if strings.Join(ss, " ") != l {
+		devs.add(DeviationStartLine)
+	}
+	if response {
+		// HTTP-Version SP Status-Code SP Reason-Phrase
+		if len(ss) == 0 {
+			return l
+		}
+		if ss[0] != "HTTP/1.1" {
+			if _, err := strconv.Atoi(ss[0]); err == nil {
+				ss = append([]string{"HTTP/1.1"}, ss...)
+			} else {
+				ss[0] = "HTTP/1.1"
+			}
+			devs.add(DeviationVersion)
+		}
+		if len(ss) == 2 {
+			code, err := strconv.Atoi(ss[1])
+			if text := http.StatusText(code); err == nil && text != "" {
+				ss = append(ss, text)
+			} else {
+				ss = append(ss, "Unknown")
+			}
+			devs.add(DeviationReasonPhrase)
+		}
+		return strings.Join(ss, " ")
+	}
+	// Method SP Request-URI SP HTTP-Version
+	if len(ss) == 0 {
+		return l
+	}
+	if m := strings.ToUpper(ss[0]); m != ss[0] {
+		ss[0] = m
+		devs.add(DeviationStartLine)
+	}
+	switch len(ss) {
+	case 1:
+		ss = append(ss, "*", "HTTP/1.1")
+		devs.add(DeviationVersion)
+	case 2:
+		ss = append(ss, "HTTP/1.1")
+		devs.add(DeviationVersion)
+	default:
+		if ss[2] != "HTTP/1.1" {
+			ss[2] = "HTTP/1.1"
+			devs.add(DeviationVersion)
+		}
+		if len(ss) > 3 {
+			ss = ss[:3]
+			devs.add(DeviationStartLine)
+		}
+	}
+	return strings.Join(ss, " ")
+}
@@ -0,0 +1,115 @@
+// Copyright 2014 Mikio Hara. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ssdp
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+)
+
+var lenientAdvertTests = []struct {
+	in     string
+	devs   []Deviation
+	strict bool // whether parsing in strict mode succeeds
+}{
+	{"NOTIFY * HTTP/1.1\r\nHOST: 239.255.255.250:1900\r\nNT: upnp:rootdevice\r\nNTS: ssdp:alive\r\nUSN: uuid:x::upnp:rootdevice\r\n\r\n", nil, true},
+	{"NOTIFY * HTTP/1.1\nHOST: 239.255.255.250:1900\nNT: upnp:rootdevice\nNTS: ssdp:alive\nUSN: uuid:x::upnp:rootdevice\n\n", []Deviation{DeviationBareLF}, true},
+	{"NOTIFY * HTTP/1.0\r\nHOST: 239.255.255.250:1900\r\nNT: upnp:rootdevice\r\nNTS: ssdp:alive\r\nUSN: uuid:x::upnp:rootdevice\r\n\r\n", []Deviation{DeviationVersion}, false},
+	{"m-search  *  HTTP/1.1\r\nHOST: 239.255.255.250:1900\r\nMAN: \"ssdp:discover\"\r\nMX: 1\r\nST: upnp:rootdevice\r\n\r\n", []Deviation{DeviationStartLine}, false},
+	{"NOTIFY * HTTP/1.1\r\nHOST: 239.255.255.250:1900\r\nNT : upnp:rootdevice\r\ngarbage\r\nNTS: ssdp:alive\r\nNTS: ssdp:byebye\r\nUSN: uuid:x::upnp:rootdevice\r\n", []Deviation{DeviationHeaderSpace, DeviationMalformedHeader, DeviationDuplicateHeader, DeviationUnterminated}, false},
+	{"NOTIFY * HTTP/1.1\r\nHOST: 239.255.255.250:1900\r\nNT: upnp:rootdevice\r\nNTS: ssdp:alive\r\nUSN: uuid:x::upnp:rootdevice\r\n\r\n\x00\x00\x00", []Deviation{DeviationTrailingGarbage}, true},
+	{"NOTIFY * HTTP/1.1\r\nHOST: 239.255.255.250:1900\r\nNT:\r\n upnp:rootdevice\r\nNTS: ssdp:alive\r\nUSN: uuid:x::upnp:rootdevice\r\n\r\n", []Deviation{DeviationFoldedHeader}, true},
+}
+
+func TestParseAdvertLenient(t *testing.T) {
+	for _, tt := range lenientAdvertTests {
+		req, devs, err := parseAdvertMode([]byte(tt.in), ParseLenient)
+		if err != nil {
+			t.Errorf("%q: %v", tt.in, err)
+			continue
+		}
+		if !reflect.DeepEqual(devs, tt.devs) {
+			t.Errorf("%q: got %v; want %v", tt.in, devs, tt.devs)
+		}
+		if devs := DeviationsFromContext(req.Context()); !reflect.DeepEqual(devs, tt.devs) {
+			t.Errorf("%q: got %v from context; want %v", tt.in, devs, tt.devs)
+		}
+		if req.Host != "239.255.255.250:1900" || req.Method == notifyMethod && req.Header.Get("Nt") != "upnp:rootdevice" || req.Header.Get("Nts") == "ssdp:byebye" {
+			t.Errorf("%q: unexpected request: %v, %v", tt.in, req.Host, req.Header)
+		}
+		if _, _, err := parseAdvertMode([]byte(tt.in), ParseStrict); (err == nil) != tt.strict {
+			t.Errorf("%q: got %v in strict mode", tt.in, err)
+		}
+	}
+}
+
+var lenientResponseTests = []struct {
+	in   string
+	body string
+	devs []Deviation
+}{
+	{"HTTP/1.1 200 OK\r\nST: upnp:rootdevice\r\nUSN: uuid:x::upnp:rootdevice\r\n\r\n", "", nil},
+	{"HTTP/1.1 200\r\nST: upnp:rootdevice\r\nUSN: uuid:x::upnp:rootdevice\r\n\r\n", "", []Deviation{DeviationReasonPhrase}},
+	{"HTTP/1.1 200 OK\nST: upnp:rootdevice\nUSN: uuid:x::upnp:rootdevice\nUSN: uuid:y::upnp:rootdevice\n\n", "", []Deviation{DeviationBareLF, DeviationDuplicateHeader}},
+	{"HTTP/1.1 200 OK\r\nST: upnp:rootdevice\r\nUSN: uuid:x::upnp:rootdevice\r\nContent-Length: 2\r\n\r\nokgarbage", "ok", []Deviation{DeviationTrailingGarbage}},
+	{"HTTP/1.1 200 OK\r\nST: upnp:rootdevice\r\nUSN: uuid:x::upnp:rootdevice\r\nContent-Length: 20\r\n\r\nok", "ok", []Deviation{DeviationContentLength}},
+}
+
+func TestParseResponseLenient(t *testing.T) {
+	for _, tt := range lenientResponseTests {
+		resp, devs, err := parseResponseMode([]byte(tt.in), ParseLenient)
+		if err != nil {
+			t.Errorf("%q: %v", tt.in, err)
+			continue
+		}
+		if !reflect.DeepEqual(devs, tt.devs) {
+			t.Errorf("%q: got %v; want %v", tt.in, devs, tt.devs)
+		}
+		b, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != 200 || resp.Header.Get("Usn") != "uuid:x::upnp:rootdevice" || string(b) != tt.body {
+			t.Errorf("%q: unexpected response: %v, %v, %q", tt.in, resp.Status, resp.Header, b)
+		}
+	}
+}
+
+func TestNormalizeFolding(t *testing.T) {
+	for _, tt := range []struct {
+		in, out string
+	}{
+		{"NOTIFY * HTTP/1.1\r\nNT:\r\n upnp:rootdevice\r\n\r\n", "NOTIFY * HTTP/1.1\r\nNT: upnp:rootdevice\r\n\r\n"},
+		{"NOTIFY * HTTP/1.1\r\nSERVER: a\r\n b\r\n\tc\r\n\r\n", "NOTIFY * HTTP/1.1\r\nSERVER: a b c\r\n\r\n"},
+	} {
+		b, devs := normalize([]byte(tt.in), false)
+		if string(b) != tt.out || !reflect.DeepEqual(devs, []Deviation{DeviationFoldedHeader}) {
+			t.Errorf("%q: got %q, %v; want %q, [%v]", tt.in, b, devs, tt.out, DeviationFoldedHeader)
+		}
+	}
+}
+
+func TestControlPointResponseDeviations(t *testing.T) {
+	cp := &ControlPoint{mux: make(map[*http.Request]chan *http.Response), mode: ParseLenient, stats: newEndpointStats()}
+	req := newAdvert(msearchMethod, DefaultIPv4Group+":1900", make(http.Header))
+	ch := cp.register(req)
+	defer cp.deregister(req)
+	p := &path{src: &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1900}, dst: &net.UDPAddr{IP: net.IPv4(192, 0, 2, 2)}}
+	var m message
+	cp.serveMessage(nil, &m, []byte("HTTP/1.1 200 OK\nST: upnp:rootdevice\nUSN: uuid:x::upnp:rootdevice\n\n"), p, time.Now())
+	select {
+	case resp := <-ch:
+		if resp.Request == nil || resp.Request.Method != msearchMethod {
+			t.Fatalf("got %v; want the issued request", resp.Request)
+		}
+		if devs := DeviationsFromResponse(resp); !reflect.DeepEqual(devs, []Deviation{DeviationBareLF}) {
+			t.Errorf("got %v; want [%v]", devs, DeviationBareLF)
+		}
+	default:
+		t.Fatal("no response received")
+	}
+}
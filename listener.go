@@ -31,9 +31,29 @@ type Listener struct {
 	// Loopback sets whether transmitted multicast packets should
 	// be copied and send back to the originator.
 	MulticastLoopback bool
+
+	// Interceptors specifies an optional chain of interceptors.
+	// Inbound and outbound messages of the endpoints created by
+	// the listener go through the interceptors in order.
+	Interceptors []Interceptor
+
+	// ParseMode specifies the strictness level of parsing inbound
+	// messages of the endpoints created by the listener.
+	ParseMode ParseMode
 }
 
 func (ln *Listener) listen() (conn, *net.UDPAddr, error) {
+	c, grp, err := ln.listenGroup()
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(ln.Interceptors) > 0 {
+		c = &interceptConn{conn: c, chain: append([]Interceptor(nil), ln.Interceptors...)}
+	}
+	return c, grp, nil
+}
+
+func (ln *Listener) listenGroup() (conn, *net.UDPAddr, error) {
 	if ln.Group == "" {
 		ln.Group = DefaultIPv4Group
 	}
@@ -0,0 +1,117 @@
+// Copyright 2014 Mikio Hara. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ssdp
+
+import (
+	"context"
+	"log"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Error kinds carried by the "kind" attribute of structured log
+// records.
+const (
+	LogKindRead               = "read"                // reading from the network failed
+	LogKindWrite              = "write"               // writing to the network failed
+	LogKindParse              = "parse"               // parsing an inbound message failed
+	LogKindUnknownDestination = "unknown-destination" // inbound message to unknown destination
+	LogKindPanic              = "panic"               // handler panicked
+	LogKindConnect            = "connect"             // connecting with a remote gateway failed
+	LogKindEvent              = "event"               // GENA subscription or event delivery failed
+)
+
+// A logRecord represents an event logged by an endpoint.
+type logRecord struct {
+	level  slog.Level
+	kind   string // error kind
+	msg    string // message for structured logging
+	path   *path
+	mifs   []net.Interface
+	method string
+	hdr    http.Header
+	peer   net.Addr // peer address when path is not available
+	err    error
+	stack  []byte
+}
+
+func (r *logRecord) attrs() []slog.Attr {
+	attrs := []slog.Attr{slog.String("kind", r.kind)}
+	if r.path != nil && r.path.src != nil {
+		attrs = append(attrs, slog.String("peer", r.path.src.String()))
+	} else if r.peer != nil {
+		attrs = append(attrs, slog.String("peer", r.peer.String()))
+	}
+	if r.path != nil {
+		if ifi := interfaceByIndex(r.mifs, r.path.ifIndex); ifi != nil {
+			attrs = append(attrs, slog.String("interface", ifi.Name))
+		}
+		if r.path.dst != nil && r.kind == LogKindUnknownDestination {
+			attrs = append(attrs, slog.String("dst", r.path.dst.String()))
+		}
+	}
+	if r.method != "" {
+		attrs = append(attrs, slog.String("method", r.method))
+	}
+	for _, f := range []struct{ key, name string }{{"Nt", "nt"}, {"St", "st"}, {"Usn", "usn"}, {"Sid", "sid"}} {
+		if v := r.hdr.Get(f.key); v != "" {
+			attrs = append(attrs, slog.String(f.name, v))
+		}
+	}
+	if r.err != nil {
+		attrs = append(attrs, slog.String("error", r.err.Error()))
+	}
+	if r.stack != nil {
+		attrs = append(attrs, slog.String("stack", string(r.stack)))
+	}
+	return attrs
+}
+
+// text returns the free-form message of the record, such as
+// "parse advert failed: malformed (peer=192.0.2.1:1900 interface=eth0)".
+func (r *logRecord) text() string {
+	var b strings.Builder
+	b.WriteString(r.msg)
+	if r.err != nil {
+		b.WriteString(": " + r.err.Error())
+	}
+	sep := " ("
+	for _, a := range r.attrs() {
+		switch a.Key {
+		case "kind", "error", "stack":
+			continue
+		}
+		b.WriteString(sep + a.Key + "=" + a.Value.String())
+		sep = " "
+	}
+	if sep == " " {
+		b.WriteString(")")
+	}
+	if r.stack != nil {
+		b.WriteString("\n")
+		b.Write(r.stack)
+	}
+	return b.String()
+}
+
+// writeLog writes the record to the structured logger sl. When sl is
+// nil, it writes the free-form message of the record to el, or the
+// log package's standard logger when el is also nil.
+func writeLog(sl *slog.Logger, el *log.Logger, r *logRecord) {
+	if sl != nil {
+		ctx := context.Background()
+		if sl.Enabled(ctx, r.level) {
+			sl.LogAttrs(ctx, r.level, r.msg, r.attrs()...)
+		}
+		return
+	}
+	if el != nil {
+		el.Print(r.text())
+	} else {
+		log.Print(r.text())
+	}
+}
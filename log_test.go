@@ -0,0 +1,57 @@
+// Copyright 2014 Mikio Hara. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ssdp
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestWriteLog(t *testing.T) {
+	var sbuf, ebuf bytes.Buffer
+	sl := slog.New(slog.NewTextHandler(&sbuf, &slog.HandlerOptions{Level: slog.LevelInfo}))
+	el := log.New(&ebuf, "", 0)
+	mifs := []net.Interface{{Index: 1, Name: "lo0"}}
+	p := &path{src: &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1900}, dst: &net.UDPAddr{IP: net.IPv4(239, 0, 0, 1)}, ifIndex: 1}
+	hdr := make(http.Header)
+	hdr.Set("Nt", "upnp:rootdevice")
+	hdr.Set("Usn", "uuid:--::upnp:rootdevice")
+
+	writeLog(sl, el, &logRecord{level: slog.LevelDebug, kind: LogKindUnknownDestination, msg: "unknown destination address", path: p, mifs: mifs})
+	if sbuf.Len() != 0 || ebuf.Len() != 0 {
+		t.Fatalf("got %q, %q; want nothing", sbuf.String(), ebuf.String())
+	}
+	writeLog(sl, el, &logRecord{level: slog.LevelWarn, kind: LogKindParse, msg: "parse advert failed", path: p, mifs: mifs, method: notifyMethod, hdr: hdr, err: errors.New("malformed")})
+	for _, s := range []string{"level=WARN", `msg="parse advert failed"`, "kind=parse", "peer=192.0.2.1:1900", "interface=lo0", "method=NOTIFY", "nt=upnp:rootdevice", "usn=uuid:--::upnp:rootdevice", "error=malformed"} {
+		if !strings.Contains(sbuf.String(), s) {
+			t.Errorf("%q not found in %q", s, sbuf.String())
+		}
+	}
+	if ebuf.Len() != 0 {
+		t.Errorf("got %q; want nothing", ebuf.String())
+	}
+
+	for _, tt := range []struct {
+		r    logRecord
+		want string
+	}{
+		{logRecord{level: slog.LevelWarn, kind: LogKindRead, msg: "read failed", err: errors.New("timeout")}, "read failed: timeout\n"},
+		{logRecord{level: slog.LevelWarn, kind: LogKindParse, msg: "parse advert failed", path: p, mifs: mifs, method: notifyMethod, hdr: hdr, err: errors.New("malformed")}, "parse advert failed: malformed (peer=192.0.2.1:1900 interface=lo0 method=NOTIFY nt=upnp:rootdevice usn=uuid:--::upnp:rootdevice)\n"},
+		{logRecord{level: slog.LevelDebug, kind: LogKindUnknownDestination, msg: "unknown destination address", path: &path{src: p.src, dst: p.dst, ifIndex: 2}, mifs: mifs}, "unknown destination address (peer=192.0.2.1:1900 dst=239.0.0.1:0)\n"},
+		{logRecord{level: slog.LevelError, kind: LogKindPanic, msg: "panic serving", peer: p.src, err: errors.New("boom"), stack: []byte("goroutine 1")}, "panic serving: boom (peer=192.0.2.1:1900)\ngoroutine 1\n"},
+	} {
+		ebuf.Reset()
+		writeLog(nil, el, &tt.r)
+		if ebuf.String() != tt.want {
+			t.Errorf("got %q; want %q", ebuf.String(), tt.want)
+		}
+	}
+}
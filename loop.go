@@ -0,0 +1,177 @@
+// Copyright 2014 Mikio Hara. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ssdp
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"hash/fnv"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// DefaultMaxHops is the default maximum number of redirectors
+	// that a SSDP message may traverse.
+	DefaultMaxHops = 4
+
+	// hopHeader is a private header that carries a list of
+	// redirector identifiers the message went through.
+	hopHeader = "X-Ssdp-Via"
+
+	loopCacheTTL = 5 * time.Second
+)
+
+// A LoopStats represents statistics of the loop prevention on a
+// redirector.
+type LoopStats struct {
+	// Reflected is the number of inbound messages dropped because
+	// they are the same as messages recently written by the
+	// redirector.
+	Reflected uint64
+
+	// Revisited is the number of inbound messages dropped because
+	// they already went through the redirector.
+	Revisited uint64
+
+	// HopLimitExceeded is the number of inbound messages dropped
+	// because they already went through too many redirectors.
+	HopLimitExceeded uint64
+}
+
+type sentMessage struct {
+	sum     uint64
+	expires time.Time
+}
+
+// A loopGuard detects redirected messages that come back to the
+// redirector.
+type loopGuard struct {
+	stats LoopStats // must be first for atomic operations
+	id    string    // redirector identifier
+
+	mu    sync.Mutex
+	sent  map[uint64]int // recently written messages and their reference counts
+	queue []sentMessage  // recently written messages in order of expiry
+}
+
+func newLoopGuard() (*loopGuard, error) {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return nil, err
+	}
+	return &loopGuard{id: hex.EncodeToString(b[:]), sent: make(map[uint64]int)}, nil
+}
+
+// stamp adds the redirector identifier to the hop header unless it
+// is already there.
+func (lg *loopGuard) stamp(hdr http.Header) {
+	if lg == nil {
+		return
+	}
+	hops := hopList(hdr)
+	for _, id := range hops {
+		if id == lg.id {
+			return
+		}
+	}
+	hdr.Set(hopHeader, strings.Join(append(hops, lg.id), ", "))
+}
+
+// record remembers the message written by the redirector.
+func (lg *loopGuard) record(b []byte) {
+	if lg == nil {
+		return
+	}
+	now := time.Now()
+	lg.mu.Lock()
+	lg.expire(now)
+	sum := checksum64(b)
+	lg.sent[sum]++
+	lg.queue = append(lg.queue, sentMessage{sum: sum, expires: now.Add(loopCacheTTL)})
+	lg.mu.Unlock()
+}
+
+// reflected reports whether the message is recently written by the
+// redirector.
+func (lg *loopGuard) reflected(b []byte) bool {
+	if lg == nil {
+		return false
+	}
+	lg.mu.Lock()
+	lg.expire(time.Now())
+	_, ok := lg.sent[checksum64(b)]
+	lg.mu.Unlock()
+	if ok {
+		atomic.AddUint64(&lg.stats.Reflected, 1)
+	}
+	return ok
+}
+
+// revisited reports whether the message already went through the
+// redirector or too many redirectors.
+func (lg *loopGuard) revisited(hdr http.Header, maxHops int) bool {
+	if lg == nil {
+		return false
+	}
+	hops := hopList(hdr)
+	for _, id := range hops {
+		if id == lg.id {
+			atomic.AddUint64(&lg.stats.Revisited, 1)
+			return true
+		}
+	}
+	if maxHops <= 0 {
+		maxHops = DefaultMaxHops
+	}
+	if len(hops) >= maxHops {
+		atomic.AddUint64(&lg.stats.HopLimitExceeded, 1)
+		return true
+	}
+	return false
+}
+
+func (lg *loopGuard) expire(now time.Time) {
+	i := 0
+	for ; i < len(lg.queue) && now.After(lg.queue[i].expires); i++ {
+		sum := lg.queue[i].sum
+		if lg.sent[sum]--; lg.sent[sum] <= 0 {
+			delete(lg.sent, sum)
+		}
+	}
+	lg.queue = lg.queue[i:]
+}
+
+func (lg *loopGuard) loopStats() LoopStats {
+	if lg == nil {
+		return LoopStats{}
+	}
+	return LoopStats{
+		Reflected:        atomic.LoadUint64(&lg.stats.Reflected),
+		Revisited:        atomic.LoadUint64(&lg.stats.Revisited),
+		HopLimitExceeded: atomic.LoadUint64(&lg.stats.HopLimitExceeded),
+	}
+}
+
+func hopList(hdr http.Header) []string {
+	var hops []string
+	for _, v := range hdr[hopHeader] {
+		for _, id := range strings.Split(v, ",") {
+			if id = strings.TrimSpace(id); id != "" {
+				hops = append(hops, id)
+			}
+		}
+	}
+	return hops
+}
+
+func checksum64(b []byte) uint64 {
+	h := fnv.New64a()
+	h.Write(b)
+	return h.Sum64()
+}
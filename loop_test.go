@@ -0,0 +1,86 @@
+// Copyright 2014 Mikio Hara. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ssdp
+
+import (
+	"net"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLoopGuard(t *testing.T) {
+	lg1, err := newLoopGuard()
+	if err != nil {
+		t.Fatal(err)
+	}
+	lg2, err := newLoopGuard()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hdr := make(http.Header)
+	lg1.stamp(hdr)
+	lg1.stamp(hdr)
+	lg2.stamp(hdr)
+	if hops := hopList(hdr); len(hops) != 2 || hops[0] != lg1.id || hops[1] != lg2.id {
+		t.Fatalf("got %v; want [%s %s]", hops, lg1.id, lg2.id)
+	}
+	if !lg1.revisited(hdr, 0) {
+		t.Error("revisited message not detected")
+	}
+	if lg3, _ := newLoopGuard(); !lg3.revisited(hdr, 2) || lg3.revisited(hdr, 3) {
+		t.Error("hop limit not respected")
+	}
+
+	b := []byte("NOTIFY * HTTP/1.1\r\n\r\n")
+	lg1.record(b)
+	if !lg1.reflected(b) || lg2.reflected(b) {
+		t.Error("reflected message not detected")
+	}
+	if st := lg1.loopStats(); st.Reflected != 1 || st.Revisited != 1 {
+		t.Fatalf("unexpected stats: %+v", st)
+	}
+}
+
+type echoRedirector struct {
+	n int32
+}
+
+func (p *echoRedirector) RedirectAdvert(rdr *AdvertRedirector) {
+	atomic.AddInt32(&p.n, 1)
+	_, ifi := rdr.ReversePath()
+	rdr.WriteTo(rdr.ForwardPath(), ifi)
+}
+
+func (p *echoRedirector) RedirectResponse(rdr *ResponseRedirector) {}
+
+func TestRedirectorLoop(t *testing.T) {
+	ln := Listener{Port: "1903", LocalPort: "1903", MulticastLoopback: true}
+	rdr, err := ln.ListenRedirector(nil)
+	if err != nil {
+		t.Skip(err)
+	}
+	defer rdr.Close()
+	var p echoRedirector
+	go rdr.Serve(&p)
+
+	c, err := net.ListenPacket("udp4", "0.0.0.0:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	dst := &net.UDPAddr{IP: rdr.GroupAddr().IP, Port: 1903}
+	if _, err := c.WriteTo([]byte("NOTIFY * HTTP/1.1\r\nHOST: 239.255.255.250:1900\r\nNTS: ssdp:alive\r\n\r\n"), dst); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(500 * time.Millisecond)
+	if n := atomic.LoadInt32(&p.n); n != 1 {
+		t.Fatalf("got %d redirections; want 1", n)
+	}
+	if st := rdr.LoopStats(); st.Reflected == 0 {
+		t.Fatalf("unexpected stats: %+v", st)
+	}
+}
@@ -0,0 +1,442 @@
+// Copyright 2014 Mikio Hara. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ssdp
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+var (
+	errShortMessage     = errors.New("short message")
+	errMalformedStart   = errors.New("malformed start line")
+	errMalformedStatus  = errors.New("malformed status code")
+	errMalformedVersion = errors.New("malformed version")
+	errMalformedHeader  = errors.New("malformed header line")
+	errUnknownMethod    = errors.New("unknown method")
+	errUnknownVersion   = errors.New("unknown version")
+)
+
+// A field represents a header field of a parsed message.
+type field struct {
+	name  []byte // field name as is on the wire
+	value []byte
+}
+
+// A message represents an inbound SSDP message parsed without
+// allocations. It is reusable and its fields refer to the parsed
+// buffer; they are valid until the buffer is modified or the message
+// is parsed again.
+//
+// The parser accepts the same messages as parseAdvert and
+// parseResponse, which are built on the net/http and net/textproto
+// packages. The serve loops dispatch on the parsed fields and convert
+// the message to net/http types only when it is passed on.
+type message struct {
+	raw []byte // parsed message
+
+	method []byte // request method
+	uri    []byte // request URI
+	proto  []byte // protocol version
+	status []byte // response status, e.g., "200 OK"
+	code   int    // response status code
+
+	fields []field
+	body   []byte
+	buf    []byte // scratch for folded header values
+}
+
+// parse parses the message b. The response indicates whether b is a
+// response message.
+func (m *message) parse(b []byte, response bool) error {
+	m.raw = b
+	m.method, m.uri, m.proto, m.status, m.code = nil, nil, nil, nil, 0
+	m.fields, m.body, m.buf = m.fields[:0], nil, m.buf[:0]
+
+	l, b, ok := cutLine(b)
+	if !ok {
+		return errShortMessage
+	}
+	if response {
+		if err := m.parseStatusLine(l); err != nil {
+			return err
+		}
+	} else {
+		if err := m.parseRequestLine(l); err != nil {
+			return err
+		}
+	}
+
+	if len(b) > 0 && (b[0] == ' ' || b[0] == '\t') {
+		return errMalformedHeader
+	}
+	for {
+		l, b, ok = cutLine(b)
+		if !ok {
+			return errShortMessage
+		}
+		if len(l) == 0 {
+			break
+		}
+		if bytes.IndexByte(l, ':') < 0 {
+			return errMalformedHeader
+		}
+		kv := trimSpace(l)
+		if len(b) > 0 && (b[0] == ' ' || b[0] == '\t') {
+			// Obsolete line folding; the lines are joined
+			// with a single space.
+			off := len(m.buf)
+			m.buf = append(m.buf, kv...)
+			for len(b) > 0 && (b[0] == ' ' || b[0] == '\t') {
+				b = bytes.TrimLeft(b, " \t")
+				m.buf = append(m.buf, ' ')
+				if l, b, ok = cutLine(b); !ok {
+					return errShortMessage
+				}
+				m.buf = append(m.buf, trimSpace(l)...)
+			}
+			kv = m.buf[off:]
+		}
+		i := bytes.IndexByte(kv, ':')
+		name, value := kv[:i], kv[i+1:]
+		if !validFieldName(name) || !validFieldValue(value) {
+			return errMalformedHeader
+		}
+		m.fields = append(m.fields, field{name: name, value: bytes.TrimLeft(value, " \t")})
+	}
+	m.body = b
+	if response {
+		if _, ok := m.framing(); !ok {
+			// Leave the validation of uncommon framing to the
+			// net/http package.
+			if _, err := parseResponse(m.raw); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (m *message) parseRequestLine(l []byte) error {
+	// Method SP Request-URI SP HTTP-Version
+	i := bytes.IndexByte(l, ' ')
+	if i < 0 {
+		return errMalformedStart
+	}
+	j := bytes.IndexByte(l[i+1:], ' ')
+	if j < 0 {
+		return errMalformedStart
+	}
+	m.method, m.uri, m.proto = l[:i], l[i+1:i+1+j], l[i+2+j:]
+	if _, _, ok := parseVersion(m.proto); !ok {
+		return errMalformedStart
+	}
+	if string(m.uri) != "*" {
+		if _, err := requestURL(string(m.uri)); err != nil {
+			return err
+		}
+	}
+	if string(m.method) != notifyMethod && string(m.method) != msearchMethod {
+		return errUnknownMethod
+	}
+	if string(m.proto) != "HTTP/1.1" {
+		return errUnknownVersion
+	}
+	return nil
+}
+
+func (m *message) parseStatusLine(l []byte) error {
+	// HTTP-Version SP Status-Code SP Reason-Phrase
+	i := bytes.IndexByte(l, ' ')
+	if i < 0 {
+		return errMalformedStart
+	}
+	m.proto, m.status = l[:i], bytes.TrimLeft(l[i+1:], " ")
+	code := m.status
+	if i := bytes.IndexByte(code, ' '); i >= 0 {
+		code = code[:i]
+	}
+	if len(code) != 3 {
+		return errMalformedStatus
+	}
+	// Mimic strconv.Atoi, which allows a sign.
+	neg := false
+	switch code[0] {
+	case '+':
+		code = code[1:]
+	case '-':
+		neg = true
+		code = code[1:]
+	}
+	n := 0
+	for _, c := range code {
+		if c < '0' || '9' < c {
+			return errMalformedStatus
+		}
+		n = n*10 + int(c-'0')
+	}
+	if neg && n != 0 {
+		return errMalformedStatus
+	}
+	m.code = n
+	if _, _, ok := parseVersion(m.proto); !ok {
+		return errMalformedVersion
+	}
+	return nil
+}
+
+// get returns the first value associated with the name. The name is
+// case-insensitive.
+func (m *message) get(name string) []byte {
+	for i := range m.fields {
+		if equalFold(m.fields[i].name, name) {
+			return m.fields[i].value
+		}
+	}
+	return nil
+}
+
+// methodName returns the method of the request message without
+// allocation.
+func (m *message) methodName() string {
+	switch string(m.method) {
+	case notifyMethod:
+		return notifyMethod
+	case msearchMethod:
+		return msearchMethod
+	}
+	return string(m.method)
+}
+
+// nts returns the value of NTS field, allocating only for unknown
+// notification sub types.
+func (m *message) nts() string {
+	v := m.get("Nts")
+	for _, s := range [...]string{"ssdp:alive", "ssdp:byebye", "ssdp:update"} {
+		if string(v) == s {
+			return s
+		}
+	}
+	return string(v)
+}
+
+// header returns the header fields converted to http.Header.
+func (m *message) header() http.Header {
+	hdr := make(http.Header, len(m.fields))
+	for _, f := range m.fields {
+		k := http.CanonicalHeaderKey(string(f.name))
+		hdr[k] = append(hdr[k], string(f.value))
+	}
+	return hdr
+}
+
+// request returns the request message converted to http.Request as
+// parseAdvert does.
+func (m *message) request() (*http.Request, error) {
+	req := &http.Request{
+		Method:     m.methodName(),
+		RequestURI: string(m.uri),
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     m.header(),
+	}
+	if req.RequestURI == "*" {
+		req.URL = &url.URL{Path: "*"}
+	} else {
+		var err error
+		if req.URL, err = requestURL(req.RequestURI); err != nil {
+			return nil, err
+		}
+	}
+	req.Host = req.URL.Host
+	if req.Host == "" {
+		req.Host = req.Header.Get("Host")
+	}
+	req.Header.Del("Host")
+	return req, nil
+}
+
+// framing returns the content length of the response message, -1
+// if unknown. It returns false when the message uses framing that is
+// left to the net/http package, such as HTTP/1.0, transfer encodings
+// and truncated bodies.
+func (m *message) framing() (int64, bool) {
+	if string(m.proto) != "HTTP/1.1" {
+		return 0, false
+	}
+	n := int64(-1)
+	for _, f := range m.fields {
+		switch {
+		case equalFold(f.name, "Transfer-Encoding"), equalFold(f.name, "Trailer"), equalFold(f.name, "Connection"), equalFold(f.name, "Pragma"):
+			return 0, false
+		case equalFold(f.name, "Content-Length"):
+			v := trimSpace(f.value)
+			if n >= 0 || len(v) == 0 || len(v) > 18 {
+				return 0, false
+			}
+			n = 0
+			for _, c := range v {
+				if c < '0' || '9' < c {
+					return 0, false
+				}
+				n = n*10 + int64(c-'0')
+			}
+		}
+	}
+	if n > int64(len(m.body)) && bodyAllowed(m.code) {
+		return 0, false
+	}
+	return n, true
+}
+
+// response returns the response message converted to http.Response
+// as parseResponse does. Unlike parseResponse, the body doesn't refer
+// to the parsed buffer.
+func (m *message) response() (*http.Response, error) {
+	n, ok := m.framing()
+	if !ok {
+		return parseResponse(append([]byte(nil), m.raw...))
+	}
+	resp := &http.Response{
+		Status:     string(m.status),
+		StatusCode: m.code,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     m.header(),
+		Body:       http.NoBody,
+	}
+	switch {
+	case !bodyAllowed(m.code), n == 0:
+	case n > 0:
+		resp.ContentLength = n
+		resp.Body = io.NopCloser(bytes.NewReader(append([]byte(nil), m.body[:n]...)))
+	default:
+		// The body of a response without Content-Length field
+		// is unbounded.
+		resp.ContentLength = -1
+		resp.Close = true
+		resp.Body = io.NopCloser(bytes.NewReader(append([]byte(nil), m.body...)))
+	}
+	return resp, nil
+}
+
+func bodyAllowed(code int) bool {
+	return code/100 != 1 && code != http.StatusNoContent && code != http.StatusNotModified
+}
+
+// cutLine returns the first line of b and the rest. The line doesn't
+// contain the trailing LF or CRLF.
+func cutLine(b []byte) (line, rest []byte, ok bool) {
+	if len(b) == 0 {
+		return nil, nil, false
+	}
+	i := bytes.IndexByte(b, '\n')
+	if i < 0 {
+		return b, nil, true
+	}
+	line, rest = b[:i], b[i+1:]
+	if i > 0 && line[i-1] == '\r' {
+		line = line[:i-1]
+	}
+	return line, rest, true
+}
+
+// trimSpace returns b without leading and trailing spaces and tabs.
+func trimSpace(b []byte) []byte {
+	return bytes.Trim(b, " \t")
+}
+
+// parseVersion is like http.ParseHTTPVersion but takes a byte slice.
+func parseVersion(b []byte) (major, minor int, ok bool) {
+	if len(b) != len("HTTP/X.Y") || string(b[:5]) != "HTTP/" || b[6] != '.' {
+		return 0, 0, false
+	}
+	if b[5] < '0' || '9' < b[5] || b[7] < '0' || '9' < b[7] {
+		return 0, 0, false
+	}
+	return int(b[5] - '0'), int(b[7] - '0'), true
+}
+
+func requestURL(uri string) (*url.URL, error) {
+	ruri, err := url.QueryUnescape(uri)
+	if err != nil {
+		return nil, errMalformedStart
+	}
+	return url.ParseRequestURI(ruri)
+}
+
+// validFieldName reports whether b is a field name accepted by the
+// net/textproto package. A space is allowed for compatibility.
+func validFieldName(b []byte) bool {
+	if len(b) == 0 {
+		return false
+	}
+	for _, c := range b {
+		if !fieldNameByte(c) {
+			return false
+		}
+	}
+	return true
+}
+
+// validFieldNameString is like validFieldName but takes a string.
+func validFieldNameString(s string) bool {
+	if len(s) == 0 {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if !fieldNameByte(s[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func fieldNameByte(c byte) bool {
+	switch {
+	case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9', c == ' ':
+		return true
+	default:
+		return strings.IndexByte("!#$%&'*+-.^_`|~", c) >= 0
+	}
+}
+
+// validFieldValue reports whether b consists of visible characters,
+// obs-text, spaces and tabs.
+func validFieldValue(b []byte) bool {
+	for _, c := range b {
+		if c < ' ' && c != '\t' || c == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// equalFold reports whether b and s are equal under ASCII case
+// folding.
+func equalFold(b []byte, s string) bool {
+	if len(b) != len(s) {
+		return false
+	}
+	for i := 0; i < len(b); i++ {
+		c, d := b[i], s[i]
+		if 'A' <= c && c <= 'Z' {
+			c += 'a' - 'A'
+		}
+		if 'A' <= d && d <= 'Z' {
+			d += 'a' - 'A'
+		}
+		if c != d {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,219 @@
+// Copyright 2014 Mikio Hara. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ssdp
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+)
+
+var messageTests = []string{
+	"M-SEARCH * HTTP/1.1\r\nHOST: 239.255.255.250:1900\r\nMAN: \"ssdp:discover\"\r\nMX: 1\r\nST: ssdp:all\r\n\r\n",
+	"NOTIFY * HTTP/1.1\r\nHost: 239.255.255.250:1900\r\nCache-Control: max-age=1800\r\nLocation: http://192.0.2.1/dd.xml\r\nNT: upnp:rootdevice\r\nNTS: ssdp:alive\r\nUSN: uuid:x::upnp:rootdevice\r\n\r\n",
+	"NOTIFY * HTTP/1.1\nHOST: 239.255.255.250:1900\nNT: upnp:rootdevice\nNTS: ssdp:byebye\n\n",
+	"NOTIFY * HTTP/1.1\r\nHOST: 239.255.255.250:1900\r\nSERVER: a\r\n  b\r\n\tc \r\nX : y\r\nNT: upnp:rootdevice\r\nNT: dup\r\n\r\nbody",
+	"NOTIFY http://example.com/x HTTP/1.1\r\nNT: upnp:rootdevice\r\n\r\n",
+	"M-SEARCH /%7Efoo HTTP/1.1\r\nHOST: [ff02::c]:1900\r\n\r\n",
+	"HTTP/1.1 200 OK\r\nCACHE-CONTROL: max-age=1800\r\nEXT:\r\nLOCATION: http://192.0.2.1/dd.xml\r\nST: upnp:rootdevice\r\nUSN: uuid:x::upnp:rootdevice\r\n\r\n",
+	"HTTP/1.1 200 OK\r\nST: upnp:rootdevice\r\nContent-Length: 4\r\n\r\nbodytrailing",
+	"HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n",
+	"HTTP/1.1 204 No Content\r\n\r\nignored",
+	"HTTP/1.1 200 OK\r\n\r\nunbounded",
+	"HTTP/1.1   200\r\nPragma: no-cache\r\n\r\n",
+	"HTTP/1.0 200 OK\r\nST: upnp:rootdevice\r\n\r\nbody",
+	"HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n4\r\nbody\r\n0\r\n\r\n",
+	"HTTP/1.1 200 OK\r\nConnection: close\r\n\r\n",
+
+	"",
+	"M-SEARCH * HTTP/1.1\r\nHOST: 239.255.255.250:1900\r\n",
+	"M-SEARCH * HTTP/1.0\r\n\r\n",
+	"GET * HTTP/1.1\r\n\r\n",
+	"M-SEARCH *\r\n\r\n",
+	"M-SEARCH * HTTP/1.1\r\n HOST: 239.255.255.250:1900\r\n\r\n",
+	"M-SEARCH * HTTP/1.1\r\nHOST 239.255.255.250:1900\r\n\r\n",
+	"M-SEARCH * HTTP/1.1\r\nHO(ST: x\r\n\r\n",
+	"M-SEARCH * HTTP/1.1\r\nHOST: x\x01\r\n\r\n",
+	"M-SEARCH %zz HTTP/1.1\r\n\r\n",
+	"HTTP/1.1 2000 OK\r\n\r\n",
+	"HTTP/1.1 -00 OK\r\n\r\n",
+	"HTTP/1.1 200 OK\r\nContent-Length: x\r\n\r\n",
+	"HTTP/1.1 200 OK\r\nContent-Length: 10\r\n\r\nshort",
+	"HTTP/2 200 OK\r\n\r\n",
+}
+
+func TestMessage(t *testing.T) {
+	var m message
+	for _, tt := range messageTests {
+		checkAdvertEquivalence(t, &m, []byte(tt))
+		checkResponseEquivalence(t, &m, []byte(tt))
+	}
+}
+
+func TestMessageAllocs(t *testing.T) {
+	var m message
+	for _, tt := range messageTests[:3] {
+		b := []byte(tt)
+		if n := testing.AllocsPerRun(100, func() {
+			if err := m.parse(b, false); err != nil {
+				t.Fatal(err)
+			}
+			m.methodName()
+			m.nts()
+		}); n != 0 {
+			t.Errorf("got %v allocs; want 0 for %q", n, tt)
+		}
+	}
+	b := []byte(messageTests[6])
+	if n := testing.AllocsPerRun(100, func() {
+		if err := m.parse(b, true); err != nil {
+			t.Fatal(err)
+		}
+	}); n != 0 {
+		t.Errorf("got %v allocs; want 0 for %q", n, b)
+	}
+}
+
+func TestServeMessageAllocs(t *testing.T) {
+	grp := &net.UDPAddr{IP: net.IPv4(239, 255, 255, 250), Port: 1900}
+	src := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1900}
+	mcast := &path{src: src, dst: grp}
+	ucast := &path{src: src, dst: &net.UDPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 1900}}
+	hdlr := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		t.Errorf("unexpected message: %v", req)
+	})
+	dev := &Device{group: grp, stats: newEndpointStats()}
+	cp := &ControlPoint{group: grp, stats: newEndpointStats()}
+	var m message
+	for _, tt := range []struct {
+		name  string
+		serve func(http.Handler, *message, []byte, *path, time.Time)
+		b     string
+		path  *path
+	}{
+		{"notify to device", dev.serveMessage, messageTests[1], mcast},
+		{"search to control point", cp.serveMessage, messageTests[0], mcast},
+		{"response with no search", cp.serveMessage, messageTests[6], ucast},
+	} {
+		b := []byte(tt.b)
+		at := time.Now()
+		if n := testing.AllocsPerRun(100, func() {
+			tt.serve(hdlr, &m, b, tt.path, at)
+		}); n != 0 {
+			t.Errorf("%s: got %v allocs; want 0", tt.name, n)
+		}
+	}
+}
+
+func FuzzParseAdvert(f *testing.F) {
+	addVendorCorpus(f)
+	var m message
+	f.Fuzz(func(t *testing.T, b []byte) {
+		checkAdvertEquivalence(t, &m, b)
+	})
+}
+
+func FuzzParseResponse(f *testing.F) {
+	addVendorCorpus(f)
+	var m message
+	f.Fuzz(func(t *testing.T, b []byte) {
+		checkResponseEquivalence(t, &m, b)
+	})
+}
+
+func checkAdvertEquivalence(t *testing.T, m *message, b []byte) {
+	t.Helper()
+	if len(b) > 1280 {
+		return
+	}
+	want, err := parseAdvert(b)
+	ferr := m.parse(b, false)
+	if (err == nil) != (ferr == nil) {
+		t.Fatalf("got %v; want %v for %q", ferr, err, b)
+	}
+	if err != nil {
+		return
+	}
+	got, err := m.request()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Method != want.Method || got.RequestURI != want.RequestURI || got.Proto != want.Proto || got.ProtoMajor != want.ProtoMajor || got.ProtoMinor != want.ProtoMinor || got.Host != want.Host || !reflect.DeepEqual(got.URL, want.URL) || !reflect.DeepEqual(got.Header, want.Header) {
+		t.Fatalf("got %+v; want %+v for %q", got, want, b)
+	}
+}
+
+func checkResponseEquivalence(t *testing.T, m *message, b []byte) {
+	t.Helper()
+	if len(b) > 1280 {
+		return
+	}
+	want, err := parseResponse(b)
+	ferr := m.parse(b, true)
+	if (err == nil) != (ferr == nil) {
+		t.Fatalf("got %v; want %v for %q", ferr, err, b)
+	}
+	if err != nil {
+		return
+	}
+	got, err := m.response()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Status != want.Status || got.StatusCode != want.StatusCode || got.Proto != want.Proto || got.ProtoMajor != want.ProtoMajor || got.ProtoMinor != want.ProtoMinor || got.ContentLength != want.ContentLength || got.Close != want.Close || !reflect.DeepEqual(got.TransferEncoding, want.TransferEncoding) || !reflect.DeepEqual(got.Header, want.Header) {
+		t.Fatalf("got %+v; want %+v for %q", got, want, b)
+	}
+	gb, gerr := io.ReadAll(got.Body)
+	wb, werr := io.ReadAll(want.Body)
+	if !bytes.Equal(gb, wb) || (gerr == nil) != (werr == nil) {
+		t.Fatalf("got %q, %v; want %q, %v for %q", gb, gerr, wb, werr, b)
+	}
+}
+
+func BenchmarkParseAdvert(b *testing.B) {
+	msg := []byte(messageTests[1])
+	b.Run("HTTP", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := parseAdvert(msg); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("Message", func(b *testing.B) {
+		b.ReportAllocs()
+		var m message
+		for i := 0; i < b.N; i++ {
+			if err := m.parse(msg, false); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkParseResponse(b *testing.B) {
+	msg := []byte(messageTests[6])
+	b.Run("HTTP", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := parseResponse(msg); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("Message", func(b *testing.B) {
+		b.ReportAllocs()
+		var m message
+		for i := 0; i < b.N; i++ {
+			if err := m.parse(msg, true); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
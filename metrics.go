@@ -0,0 +1,130 @@
+// Copyright 2014 Mikio Hara. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ssdp
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// A MetricsExporter represents an exporter that exposes statistics of
+// endpoints in the Prometheus text exposition format. It implements
+// http.Handler.
+type MetricsExporter struct {
+	mu  sync.RWMutex
+	eps map[string]func() Stats
+}
+
+// Register registers the statistics source of the endpoint. The name
+// is used as the value of the endpoint label. For example,
+//
+//	var me ssdp.MetricsExporter
+//	me.Register("device", dev.Stats)
+//	http.Handle("/metrics", &me)
+func (me *MetricsExporter) Register(name string, stats func() Stats) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	if me.eps == nil {
+		me.eps = make(map[string]func() Stats)
+	}
+	me.eps[name] = stats
+}
+
+// Deregister deregisters the statistics source of the endpoint.
+func (me *MetricsExporter) Deregister(name string) {
+	me.mu.Lock()
+	delete(me.eps, name)
+	me.mu.Unlock()
+}
+
+// ServeHTTP implements the ServeHTTP method of http.Handler
+// interface.
+func (me *MetricsExporter) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	me.mu.RLock()
+	names := make([]string, 0, len(me.eps))
+	sts := make(map[string]Stats, len(me.eps))
+	for name, stats := range me.eps {
+		names = append(names, name)
+		sts[name] = stats()
+	}
+	me.mu.RUnlock()
+	sort.Strings(names)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	bw := bufio.NewWriter(w)
+	defer bw.Flush()
+	writeMessageMetrics(bw, "ssdp_messages_received_total", "Number of received SSDP messages.", names, sts, func(st *Stats) map[MessageKind]uint64 { return st.Received })
+	writeMessageMetrics(bw, "ssdp_messages_sent_total", "Number of sent SSDP messages.", names, sts, func(st *Stats) map[MessageKind]uint64 { return st.Sent })
+	writeCounterMetrics(bw, "ssdp_parse_failures_total", "Number of inbound SSDP messages failed to parse.", names, sts, func(st *Stats) uint64 { return st.ParseFailures })
+	writeCounterMetrics(bw, "ssdp_unknown_destinations_total", "Number of inbound SSDP messages dropped due to unknown destination.", names, sts, func(st *Stats) uint64 { return st.UnknownDestinations })
+	writeCounterMetrics(bw, "ssdp_handler_panics_total", "Number of panics in handlers.", names, sts, func(st *Stats) uint64 { return st.HandlerPanics })
+	fmt.Fprintf(bw, "# HELP ssdp_write_failures_total Number of write failures.\n# TYPE ssdp_write_failures_total counter\n")
+	for _, name := range names {
+		wfs := sts[name].WriteFailures
+		ifnames := make([]string, 0, len(wfs))
+		for ifname := range wfs {
+			ifnames = append(ifnames, ifname)
+		}
+		sort.Strings(ifnames)
+		for _, ifname := range ifnames {
+			fmt.Fprintf(bw, "ssdp_write_failures_total{endpoint=%s,interface=%s} %d\n", quoteLabel(name), quoteLabel(ifname), wfs[ifname])
+		}
+	}
+	fmt.Fprintf(bw, "# HELP ssdp_search_latency_seconds Latency between sending M-SEARCH messages and receiving responses.\n# TYPE ssdp_search_latency_seconds histogram\n")
+	for _, name := range names {
+		h := sts[name].SearchLatency
+		if len(h.Counts) != len(h.Bounds)+1 {
+			continue
+		}
+		var n uint64
+		for i, b := range h.Bounds {
+			n += h.Counts[i]
+			fmt.Fprintf(bw, "ssdp_search_latency_seconds_bucket{endpoint=%s,le=\"%s\"} %d\n", quoteLabel(name), strconv.FormatFloat(b.Seconds(), 'g', -1, 64), n)
+		}
+		fmt.Fprintf(bw, "ssdp_search_latency_seconds_bucket{endpoint=%s,le=\"+Inf\"} %d\n", quoteLabel(name), h.Count)
+		fmt.Fprintf(bw, "ssdp_search_latency_seconds_sum{endpoint=%s} %s\n", quoteLabel(name), strconv.FormatFloat(h.Sum.Seconds(), 'g', -1, 64))
+		fmt.Fprintf(bw, "ssdp_search_latency_seconds_count{endpoint=%s} %d\n", quoteLabel(name), h.Count)
+	}
+}
+
+func writeMessageMetrics(bw *bufio.Writer, metric, help string, names []string, sts map[string]Stats, counts func(*Stats) map[MessageKind]uint64) {
+	fmt.Fprintf(bw, "# HELP %s %s\n# TYPE %s counter\n", metric, help, metric)
+	for _, name := range names {
+		st := sts[name]
+		m := counts(&st)
+		kinds := make([]MessageKind, 0, len(m))
+		for k := range m {
+			kinds = append(kinds, k)
+		}
+		sort.Slice(kinds, func(i, j int) bool {
+			if kinds[i].Method != kinds[j].Method {
+				return kinds[i].Method < kinds[j].Method
+			}
+			return kinds[i].NTS < kinds[j].NTS
+		})
+		for _, k := range kinds {
+			fmt.Fprintf(bw, "%s{endpoint=%s,method=%s,nts=%s} %d\n", metric, quoteLabel(name), quoteLabel(k.Method), quoteLabel(k.NTS), m[k])
+		}
+	}
+}
+
+func writeCounterMetrics(bw *bufio.Writer, metric, help string, names []string, sts map[string]Stats, count func(*Stats) uint64) {
+	fmt.Fprintf(bw, "# HELP %s %s\n# TYPE %s counter\n", metric, help, metric)
+	for _, name := range names {
+		st := sts[name]
+		fmt.Fprintf(bw, "%s{endpoint=%s} %d\n", metric, quoteLabel(name), count(&st))
+	}
+}
+
+var labelReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func quoteLabel(s string) string {
+	return `"` + labelReplacer.Replace(s) + `"`
+}
@@ -0,0 +1,14 @@
+// Copyright 2014 Mikio Hara. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build darwin || linux || solaris
+
+package ssdp
+
+// The outbound multicast network interface is selected per packet
+// with IP_PKTINFO and IPV6_PKTINFO control messages.
+const (
+	pktinfoIPv4 = true
+	pktinfoIPv6 = true
+)
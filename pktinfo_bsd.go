@@ -0,0 +1,13 @@
+// Copyright 2014 Mikio Hara. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build dragonfly || freebsd || netbsd || openbsd
+
+package ssdp
+
+// IP_PKTINFO is not available for sending IPv4 messages.
+const (
+	pktinfoIPv4 = false
+	pktinfoIPv6 = true
+)
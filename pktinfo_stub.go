@@ -0,0 +1,14 @@
+// Copyright 2014 Mikio Hara. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !solaris
+
+package ssdp
+
+// The outbound multicast network interface is selected by the
+// socket option, serialized with writes.
+const (
+	pktinfoIPv4 = false
+	pktinfoIPv6 = false
+)
@@ -0,0 +1,224 @@
+// Copyright 2014 Mikio Hara. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ssdp
+
+import (
+	"log"
+	"log/slog"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A CachingProxy represents a caching SSDP discovery proxy. It learns
+// devices from NOTIFY messages and answers M-SEARCH messages on
+// behalf of the devices until the advertisements expire.
+type CachingProxy struct {
+	// ErrorLog specified an optional logger for errors. If it is
+	// nil, logging goes to os.Stderr via the log package's
+	// standard logger.
+	ErrorLog *log.Logger
+
+	// Logger optionally specifies a structured logger. If it is
+	// not nil, it is used instead of ErrorLog.
+	Logger *slog.Logger
+
+	// Mark specifies optional headers that are added to the
+	// responses answered from the cache. If it is nil, the
+	// responses carry "X-Ssdp-Proxy: cache".
+	Mark http.Header
+
+	cp  *ControlPoint
+	dev *Device
+
+	mu    sync.Mutex
+	cache map[string]*cachedAdvert // advertisements indexed by USN
+}
+
+type cachedAdvert struct {
+	nt      string // notification type
+	hdr     Header // advertised header in order, including NT field
+	expires time.Time
+}
+
+// ListenCachingProxy listens on the UDP network Listener.Group and
+// Listener.Port, and returns a caching proxy. If mifs is nil, it
+// tries to listen on all available multicast network interfaces.
+func (ln *Listener) ListenCachingProxy(mifs []net.Interface) (*CachingProxy, error) {
+	cp, err := ln.ListenControlPoint(mifs)
+	if err != nil {
+		return nil, err
+	}
+	dev, err := ln.ListenDevice(mifs)
+	if err != nil {
+		cp.Close()
+		return nil, err
+	}
+	return &CachingProxy{cp: cp, dev: dev, cache: make(map[string]*cachedAdvert)}, nil
+}
+
+// Serve starts to learn devices and answer searches. It returns when
+// either of the control point and device fails.
+func (px *CachingProxy) Serve() error {
+	px.cp.ErrorLog = px.ErrorLog
+	px.dev.ErrorLog = px.ErrorLog
+	px.cp.Logger = px.Logger
+	px.dev.Logger = px.Logger
+	errCh := make(chan error, 2)
+	go func() {
+		errCh <- px.cp.Serve(http.HandlerFunc(px.learn))
+	}()
+	go func() {
+		errCh <- px.dev.Serve(http.HandlerFunc(px.answer))
+	}()
+	return <-errCh
+}
+
+// GroupAddr returns the joined group network address.
+func (px *CachingProxy) GroupAddr() *net.UDPAddr {
+	return px.cp.GroupAddr()
+}
+
+// Close closes the caching proxy.
+func (px *CachingProxy) Close() error {
+	err := px.cp.Close()
+	if err1 := px.dev.Close(); err == nil {
+		err = err1
+	}
+	return err
+}
+
+// learn updates the cache with the NOTIFY message.
+func (px *CachingProxy) learn(w http.ResponseWriter, req *http.Request) {
+	usn := req.Header.Get("Usn")
+	if usn == "" {
+		return
+	}
+	px.mu.Lock()
+	defer px.mu.Unlock()
+	switch req.Header.Get("Nts") {
+	case "ssdp:alive":
+		secs := maxAge(req.Header.Get("Cache-Control"))
+		if secs <= 0 {
+			return
+		}
+		hdr := parseHeader(RawMessageFromContext(req.Context())).merge(req.Header, "")
+		hdr.Del("Nts")
+		hdr.Del(hopHeader)
+		px.cache[usn] = &cachedAdvert{nt: req.Header.Get("Nt"), hdr: hdr, expires: time.Now().Add(time.Duration(secs) * time.Second)}
+	case "ssdp:update":
+		if ca, ok := px.cache[usn]; ok {
+			for _, k := range []string{"LOCATION", "CONFIGID.UPNP.ORG", "SEARCHPORT.UPNP.ORG"} {
+				if v := req.Header.Get(k); v != "" {
+					ca.hdr.Set(k, v)
+				}
+			}
+			if v := req.Header.Get("Nextbootid.upnp.org"); v != "" {
+				ca.hdr.Set("BOOTID.UPNP.ORG", v)
+			}
+		}
+	case "ssdp:byebye":
+		delete(px.cache, usn)
+	}
+}
+
+// answer responds to the M-SEARCH message with the cached
+// advertisements. The responses are spread over the MX period.
+func (px *CachingProxy) answer(w http.ResponseWriter, req *http.Request) {
+	in := inboundFromContext(req.Context())
+	if in == nil {
+		return
+	}
+	st := req.Header.Get("St")
+	if st == "" {
+		return
+	}
+	mx, err := strconv.Atoi(req.Header.Get("Mx"))
+	if err != nil || mx < 1 {
+		mx = 1
+	}
+	if mx > 5 {
+		mx = 5
+	}
+	for _, hdr := range px.responses(st) {
+		hdr := hdr
+		time.AfterFunc(time.Duration(rand.Int63n(int64(mx)*int64(time.Second))), func() {
+			if err := px.dev.Respond(req, hdr); err != nil {
+				px.dev.logEvent(logRecord{level: slog.LevelWarn, kind: LogKindWrite, msg: "answer failed", path: in.path, mifs: in.mifs, method: MethodResponse, hdr: hdr.HTTPHeader(), err: err})
+			}
+		})
+	}
+}
+
+// responses returns the headers of the response messages to the
+// search target st. The fields keep the order and casing of the
+// advertisements, with NT field turned into ST field.
+func (px *CachingProxy) responses(st string) []Header {
+	now := time.Now()
+	px.mu.Lock()
+	defer px.mu.Unlock()
+	var hs []Header
+	for usn, ca := range px.cache {
+		if now.After(ca.expires) {
+			delete(px.cache, usn)
+			continue
+		}
+		if st != "ssdp:all" && st != ca.nt {
+			continue
+		}
+		hdr := make(Header, 0, len(ca.hdr)+3)
+		for _, f := range ca.hdr {
+			if strings.EqualFold(f.Name, "Nt") {
+				f = HeaderField{Name: searchTargetName(f.Name), Value: ca.nt}
+			}
+			hdr = append(hdr, f)
+		}
+		hdr.Set("ST", ca.nt)
+		hdr.Set("EXT", "")
+		if px.Mark == nil {
+			hdr.Set("X-Ssdp-Proxy", "cache")
+		}
+		for k, vs := range px.Mark {
+			hdr.Del(k)
+			for _, v := range vs {
+				hdr.Add(k, v)
+			}
+		}
+		hs = append(hs, hdr)
+	}
+	return hs
+}
+
+// searchTargetName returns the name of ST field in the casing of the
+// NT field name nt.
+func searchTargetName(nt string) string {
+	if nt[0] == 'n' {
+		return "s" + nt[1:]
+	}
+	return "S" + nt[1:]
+}
+
+func maxAge(s string) int {
+	for _, d := range strings.Split(s, ",") {
+		d = strings.TrimSpace(d)
+		if !strings.HasPrefix(strings.ToLower(d), "max-age") {
+			continue
+		}
+		d = strings.TrimSpace(d[len("max-age"):])
+		if !strings.HasPrefix(d, "=") {
+			continue
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(d[1:]))
+		if err != nil {
+			return 0
+		}
+		return n
+	}
+	return 0
+}
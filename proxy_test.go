@@ -0,0 +1,133 @@
+// Copyright 2014 Mikio Hara. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ssdp
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCachingProxy(t *testing.T) {
+	pxln := Listener{Port: "1908", LocalPort: "1908"}
+	px, err := pxln.ListenCachingProxy(nil)
+	if err != nil {
+		t.Skip(err)
+	}
+	defer px.Close()
+	px.Mark = http.Header{"Via-Proxy": []string{"test"}}
+	go px.Serve()
+
+	devln := Listener{Port: "1908", LocalPort: "1909", MulticastLoopback: true}
+	dev, err := devln.ListenDevice(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dev.Close()
+	for _, nts := range []string{"ssdp:alive", "ssdp:byebye", "ssdp:alive"} {
+		for _, usn := range []string{"uuid:proxy-test::upnp:rootdevice", "uuid:proxy-test-gone::upnp:rootdevice"} {
+			if nts == "ssdp:alive" && usn == "uuid:proxy-test-gone::upnp:rootdevice" {
+				continue
+			}
+			hdr := make(http.Header)
+			hdr.Set("Cache-Control", "max-age=60")
+			hdr.Set("Location", "http://127.0.0.1:5963/dd.xml")
+			hdr.Set("Nt", "upnp:rootdevice")
+			hdr.Set("Nts", nts)
+			hdr.Set("Usn", usn)
+			if err := dev.Notify(hdr, nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	cpln := Listener{Port: "1908", LocalPort: "1910", MulticastLoopback: true}
+	cp, err := cpln.ListenControlPoint(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cp.Close()
+	go cp.Serve(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	deadline := time.Now().Add(10 * time.Second)
+	for _, st := range []string{"upnp:rootdevice", "ssdp:all", "urn:schemas-upnp-org:device:Unknown:1"} {
+		hdr := make(http.Header)
+		hdr.Set("Man", `"ssdp:discover"`)
+		hdr.Set("Mx", "1")
+		hdr.Set("St", st)
+		for {
+			resps, err := cp.MSearch(hdr, nil, 1500*time.Millisecond)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var n int
+			for _, resp := range resps {
+				resp.Body.Close()
+				if resp.Header.Get("Via-Proxy") != "test" {
+					continue
+				}
+				n++
+				if resp.Header.Get("Usn") != "uuid:proxy-test::upnp:rootdevice" || resp.Header.Get("St") != "upnp:rootdevice" || resp.Header.Get("Location") != "http://127.0.0.1:5963/dd.xml" {
+					t.Errorf("unexpected response: %v", resp.Header)
+				}
+			}
+			if st == "urn:schemas-upnp-org:device:Unknown:1" {
+				if n != 0 {
+					t.Errorf("got %d responses for %s; want 0", n, st)
+				}
+				break
+			}
+			if n == 0 {
+				if time.Now().After(deadline) {
+					t.Fatalf("no response for %s", st)
+				}
+				continue
+			}
+			if n != 1 {
+				t.Errorf("got %d responses for %s; want 1", n, st)
+			}
+			break
+		}
+	}
+}
+
+func TestCachingProxyHeaderOrder(t *testing.T) {
+	raw := []byte("NOTIFY * HTTP/1.1\r\n" +
+		"Host: 239.255.255.250:1900\r\n" +
+		"Cache-Control: max-age=60\r\n" +
+		"Location: http://127.0.0.1:5963/dd.xml\r\n" +
+		"nt: upnp:rootdevice\r\n" +
+		"NTS: ssdp:alive\r\n" +
+		"X-Vendor: a\r\n" +
+		"usn: uuid:proxy-test::upnp:rootdevice\r\n" +
+		"\r\n")
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(raw)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req = withInbound(req, &inbound{raw: raw, path: &path{src: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1900}}})
+	px := &CachingProxy{cache: make(map[string]*cachedAdvert)}
+	px.learn(nil, req)
+	hs := px.responses("upnp:rootdevice")
+	if len(hs) != 1 {
+		t.Fatalf("got %d responses; want 1", len(hs))
+	}
+	want := Header{
+		{Name: "Cache-Control", Value: "max-age=60"},
+		{Name: "Location", Value: "http://127.0.0.1:5963/dd.xml"},
+		{Name: "st", Value: "upnp:rootdevice"},
+		{Name: "X-Vendor", Value: "a"},
+		{Name: "usn", Value: "uuid:proxy-test::upnp:rootdevice"},
+		{Name: "EXT", Value: ""},
+		{Name: "X-Ssdp-Proxy", Value: "cache"},
+	}
+	if !reflect.DeepEqual(hs[0], want) {
+		t.Errorf("got %v; want %v", hs[0], want)
+	}
+}
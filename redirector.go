@@ -6,9 +6,13 @@ package ssdp
 
 import (
 	"errors"
+	"fmt"
 	"log"
+	"log/slog"
 	"net"
+	"net/http"
 	"runtime"
+	"time"
 )
 
 // A Redirector represents a back-to-back SSDP entity.
@@ -18,21 +22,38 @@ type Redirector struct {
 	// standard logger.
 	ErrorLog *log.Logger
 
+	// Logger optionally specifies a structured logger. If it is
+	// not nil, it is used instead of ErrorLog. Messages to unknown
+	// destinations are logged at slog.LevelDebug.
+	Logger *slog.Logger
+
+	// MaxHops specifies the maximum number of redirectors that an
+	// inbound SSDP message may have gone through. If it is zero,
+	// DefaultMaxHops will be used.
+	MaxHops int
+
 	conn                      // network connection endpoint
 	group   *net.UDPAddr      // group address
 	unicast func(net.IP) bool // unicast address filter
 	mifs    []net.Interface   // multicast network interfaces
+	mode    ParseMode         // parsing strictness
+	guard   *loopGuard        // loop prevention
+	srch    searchTable       // forwarded searches
 }
 
 // ListenRedirector listens on the UDP network Listener.Group and
 // Listener.Port, and returns a redirector. If mifs is nil, it tries
 // to listen on all available multicast network interfaces.
 func (ln *Listener) ListenRedirector(mifs []net.Interface) (*Redirector, error) {
-	var err error
-	rdr := &Redirector{}
+	guard, err := newLoopGuard()
+	if err != nil {
+		return nil, err
+	}
+	rdr := &Redirector{guard: guard}
 	if rdr.conn, rdr.group, err = ln.listen(); err != nil {
 		return nil, err
 	}
+	rdr.mode = ln.ParseMode
 	if rdr.group.IP.To4() != nil {
 		rdr.unicast = ipv4Unicast
 	} else {
@@ -55,64 +76,169 @@ type RedirectHandler interface {
 	RedirectResponse(*ResponseRedirector)
 }
 
+// A MalformedMessage represents an inbound SSDP message that cannot
+// be parsed.
+type MalformedMessage struct {
+	Data      []byte         // received message
+	Src       *net.UDPAddr   // source address
+	Dst       *net.UDPAddr   // destination address
+	Interface *net.Interface // inbound interface
+	Time      time.Time      // receive time
+	Err       error          // parse error
+}
+
+// A MalformedHandler is an optional interface implemented by a
+// RedirectHandler to receive inbound SSDP messages that cannot be
+// parsed.
+type MalformedHandler interface {
+	// RedirectMalformed handles an inbound malformed SSDP
+	// message.
+	RedirectMalformed(*MalformedMessage)
+}
+
 // Serve starts to handle incoming SSDP messages from either SSDP
 // control points or SSDP devices. The handler must not be nil.
+//
+// A response to a M-SEARCH message forwarded by the redirector is
+// relayed to the original requester after the RedirectResponse
+// method of the handler returns, unless the handler calls the Drop
+// method of the response. The handler may modify the header of such
+// response but doesn't need to write it.
 func (rdr *Redirector) Serve(hdlr RedirectHandler) error {
 	if rdr == nil {
 		return errors.New("invalid http handler")
 	}
-	b := make([]byte, 1280)
+	ims := newInMessages(1280)
+	var m message
 	for {
-		n, path, err := rdr.readFrom(b)
+		k, err := rdr.readBatch(ims)
 		if err != nil {
 			if nerr, ok := err.(net.Error); ok && nerr.Temporary() {
-				rdr.logf("read failed: %v", err)
+				rdr.logEvent(logRecord{level: slog.LevelWarn, kind: LogKindRead, msg: "read failed", err: err})
 				continue
 			}
 			return err
 		}
-		if !path.dst.IP.IsMulticast() {
-			resp, err := parseResponse(b[:n])
-			if err != nil {
-				rdr.logf("parse response failed: %v", err)
-				continue
-			}
-			resprdr := newResponseRedirector(rdr.conn, rdr.mifs, rdr.group, path, resp)
-			go func() {
-				defer func() {
-					if err := recover(); err != nil {
-						const size = 64 << 10
-						b := make([]byte, size)
-						b = b[:runtime.Stack(b, false)]
-						rdr.logf("panic serving %v: %v\n%s", resprdr.path.src, err, b)
-					}
-				}()
-				hdlr.RedirectResponse(resprdr)
-			}()
-			continue
+		at := time.Now()
+		for i := range ims[:k] {
+			rdr.serveMessage(hdlr, &m, ims[i].b[:ims[i].n], ims[i].path, at)
 		}
-		if !path.dst.IP.Equal(rdr.group.IP) {
-			rdr.logf("unknown destination address: %v on %v", path.dst, interfaceByIndex(rdr.mifs, path.ifIndex).Name)
-			continue
+	}
+}
+
+// serveMessage handles the inbound SSDP message b received at the
+// time at. The message m is used for parsing b.
+func (rdr *Redirector) serveMessage(hdlr RedirectHandler, m *message, b []byte, path *path, at time.Time) {
+	if rdr.guard.reflected(b) {
+		return
+	}
+	raw := make([]byte, len(b))
+	copy(raw, b)
+	if !path.dst.IP.IsMulticast() {
+		var resp *http.Response
+		devs, err := m.parseMode(raw, true, rdr.mode)
+		if err == nil {
+			resp, err = m.response()
 		}
-		req, err := parseAdvert(b[:n])
 		if err != nil {
-			rdr.logf("parse advert failed: %v", err)
-			continue
+			rdr.logEvent(logRecord{level: slog.LevelWarn, kind: LogKindParse, msg: "parse response failed", path: path, mifs: rdr.mifs, err: err})
+			rdr.malformed(hdlr, raw, at, path, err)
+			return
 		}
-		advrdr := newAdvertRedirector(rdr.conn, rdr.mifs, rdr.group, path, req)
-		go func() {
-			defer func() {
-				if err := recover(); err != nil {
-					const size = 64 << 10
-					b := make([]byte, size)
-					b = b[:runtime.Stack(b, false)]
-					rdr.logf("panic serving %v: %v\n%s", advrdr.path.src, err, b)
-				}
-			}()
-			hdlr.RedirectAdvert(advrdr)
-		}()
+		if rdr.guard.revisited(resp.Header, rdr.MaxHops) {
+			return
+		}
+		resprdr := newResponseRedirector(rdr.conn, rdr.mifs, rdr.group, path, resp)
+		resprdr.raw = raw
+		resprdr.at = at
+		resprdr.devs = devs
+		resprdr.guard = rdr.guard
+		ss := rdr.srch.lookup(resp.Header.Get("St"), path.ifIndex)
+		rdr.dispatch(path.src, func() { rdr.redirectResponse(hdlr, resprdr, ss) })
+		return
+	}
+	if !path.dst.IP.Equal(rdr.group.IP) {
+		rdr.logEvent(logRecord{level: slog.LevelDebug, kind: LogKindUnknownDestination, msg: "unknown destination address", path: path, mifs: rdr.mifs})
+		return
+	}
+	var req *http.Request
+	devs, err := m.parseMode(raw, false, rdr.mode)
+	if err == nil {
+		req, err = m.request()
+	}
+	if err != nil {
+		rdr.logEvent(logRecord{level: slog.LevelWarn, kind: LogKindParse, msg: "parse advert failed", path: path, mifs: rdr.mifs, err: err})
+		rdr.malformed(hdlr, raw, at, path, err)
+		return
+	}
+	if rdr.guard.revisited(req.Header, rdr.MaxHops) {
+		return
 	}
+	req = withDeviations(req, devs)
+	advrdr := newAdvertRedirector(rdr.conn, rdr.mifs, rdr.group, path, req)
+	advrdr.raw = raw
+	advrdr.at = at
+	advrdr.devs = devs
+	advrdr.guard = rdr.guard
+	advrdr.srch = &rdr.srch
+	rdr.dispatch(path.src, func() { hdlr.RedirectAdvert(advrdr) })
+}
+
+func (rdr *Redirector) malformed(hdlr RedirectHandler, raw []byte, at time.Time, path *path, err error) {
+	mh, ok := hdlr.(MalformedHandler)
+	if !ok {
+		return
+	}
+	path.dst.Port = rdr.group.Port
+	ifi := interfaceByIndex(rdr.mifs, path.ifIndex)
+	if ifi != nil && ipv6LinkLocal(path.src.IP) {
+		path.src.Zone = ifi.Name
+	}
+	msg := &MalformedMessage{Data: raw, Src: path.src, Dst: path.dst, Interface: ifi, Time: at, Err: err}
+	rdr.dispatch(path.src, func() { mh.RedirectMalformed(msg) })
+}
+
+// redirectResponse passes the response to the handler, and relays it
+// to the requesters of forwarded searches ss unless the handler drops
+// it.
+func (rdr *Redirector) redirectResponse(hdlr RedirectHandler, resp *ResponseRedirector, ss []*pendingSearch) {
+	hdlr.RedirectResponse(resp)
+	if resp.drop {
+		return
+	}
+	rdr.relay(resp, ss)
+}
+
+// relay writes the response to the requesters of forwarded searches.
+func (rdr *Redirector) relay(resp *ResponseRedirector, ss []*pendingSearch) {
+	if len(ss) == 0 {
+		return
+	}
+	b, err := resp.marshal()
+	if err != nil {
+		rdr.logEvent(logRecord{level: slog.LevelWarn, kind: LogKindWrite, msg: "relay response failed", peer: resp.path.src, method: MethodResponse, hdr: resp.Header(), err: err})
+		return
+	}
+	for _, s := range ss {
+		if _, err := s.reply(b); err != nil {
+			rdr.logEvent(logRecord{level: slog.LevelWarn, kind: LogKindWrite, msg: "relay response failed", peer: s.src, method: MethodResponse, hdr: resp.Header(), err: err})
+		}
+	}
+}
+
+// dispatch runs fn on a new goroutine and recovers a panic in fn.
+func (rdr *Redirector) dispatch(src *net.UDPAddr, fn func()) {
+	go func() {
+		defer func() {
+			if err := recover(); err != nil {
+				const size = 64 << 10
+				b := make([]byte, size)
+				b = b[:runtime.Stack(b, false)]
+				rdr.logEvent(logRecord{level: slog.LevelError, kind: LogKindPanic, msg: "panic serving", peer: src, err: fmt.Errorf("%v", err), stack: b})
+			}
+		}()
+		fn()
+	}()
 }
 
 // GroupAddr returns the joined group network address.
@@ -134,10 +260,11 @@ func (rdr *Redirector) Interfaces() []net.Interface {
 	return rdr.mifs
 }
 
-func (rdr *Redirector) logf(format string, args ...interface{}) {
-	if rdr.ErrorLog != nil {
-		rdr.ErrorLog.Printf(format, args...)
-	} else {
-		log.Printf(format, args...)
-	}
+// LoopStats returns statistics of the loop prevention.
+func (rdr *Redirector) LoopStats() LoopStats {
+	return rdr.guard.loopStats()
+}
+
+func (rdr *Redirector) logEvent(r logRecord) {
+	writeLog(rdr.Logger, rdr.ErrorLog, &r)
 }
@@ -7,6 +7,9 @@ package ssdp
 import (
 	"net"
 	"testing"
+	"time"
+
+	"golang.org/x/net/ipv4"
 )
 
 type proxy struct {
@@ -46,3 +49,49 @@ func TestRedirector(t *testing.T) {
 		p.Redirector.Close()
 	}
 }
+
+type sniffer struct {
+	proxy
+	ch chan *MalformedMessage
+}
+
+func (s *sniffer) RedirectMalformed(msg *MalformedMessage) { s.ch <- msg }
+
+func TestRedirectorMalformed(t *testing.T) {
+	ln := Listener{LocalPort: "1902"}
+	rdr, err := ln.ListenRedirector(nil)
+	if err != nil {
+		t.Skip(err)
+	}
+	defer rdr.Close()
+	if len(rdr.Interfaces()) == 0 {
+		t.Skip("no available multicast network interface found")
+	}
+	s := sniffer{ch: make(chan *MalformedMessage, 1)}
+	go rdr.Serve(&s)
+
+	c, err := net.ListenPacket("udp4", "0.0.0.0:0")
+	if err != nil {
+		t.Skip(err)
+	}
+	defer c.Close()
+	p := ipv4.NewPacketConn(c)
+	if err := p.SetMulticastInterface(&rdr.Interfaces()[0]); err != nil {
+		t.Skip(err)
+	}
+	if err := p.SetMulticastLoopback(true); err != nil {
+		t.Skip(err)
+	}
+	dst := &net.UDPAddr{IP: rdr.GroupAddr().IP, Port: 1902}
+	if _, err := c.WriteTo([]byte("NOTIFY * HTTP/1.0\r\n\r\n"), dst); err != nil {
+		t.Skip(err)
+	}
+	select {
+	case msg := <-s.ch:
+		if msg.Err == nil || string(msg.Data) != "NOTIFY * HTTP/1.0\r\n\r\n" {
+			t.Fatalf("unexpected malformed message: %+v", msg)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("no malformed message received")
+	}
+}
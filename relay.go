@@ -0,0 +1,117 @@
+// Copyright 2014 Mikio Hara. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ssdp
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// relayGrace is an extra lifetime of forwarded search entries for
+// the transit of responses.
+const relayGrace = 500 * time.Millisecond
+
+// A pendingSearch represents a forwarded M-SEARCH message waiting
+// for responses.
+type pendingSearch struct {
+	src     *net.UDPAddr // requester
+	ifIndex int          // inbound interface index, 0 for non-local requesters
+	st      string       // search target
+	expires time.Time
+
+	reply func([]byte) (int, error) // writes a response to the requester
+}
+
+// A searchTable holds forwarded M-SEARCH messages.
+type searchTable struct {
+	mu sync.Mutex
+	ss []*pendingSearch
+}
+
+// register remembers the requester src of the forwarded M-SEARCH
+// message req. The function reply writes a response to the
+// requester. The interface index ifIndex is zero unless the
+// requester is on the link where responses are received directly.
+// It does nothing when req is not a M-SEARCH message.
+func (tab *searchTable) register(req *http.Request, src *net.UDPAddr, ifIndex int, reply func([]byte) (int, error)) {
+	if req.Method != msearchMethod {
+		return
+	}
+	tab.add(&pendingSearch{src: src, ifIndex: ifIndex, st: req.Header.Get("St"), reply: reply}, req.Header.Get("Mx"))
+}
+
+// unicastReply returns a function that writes a response to dst on
+// the endpoint c.
+func unicastReply(c conn, dst *net.UDPAddr) func([]byte) (int, error) {
+	return func(b []byte) (int, error) { return c.writeTo(b, dst, nil) }
+}
+
+// add registers the forwarded search. The entry expires after MX
+// seconds specified by mx.
+func (tab *searchTable) add(ps *pendingSearch, mx string) {
+	n, err := strconv.Atoi(mx)
+	if err != nil || n < 1 {
+		n = 1
+	}
+	if n > 5 {
+		n = 5
+	}
+	now := time.Now()
+	ps.expires = now.Add(time.Duration(n)*time.Second + relayGrace)
+	tab.mu.Lock()
+	defer tab.mu.Unlock()
+	tab.expire(now)
+	for _, s := range tab.ss {
+		if s.st == ps.st && s.ifIndex == ps.ifIndex && s.src.String() == ps.src.String() {
+			if ps.expires.After(s.expires) {
+				s.expires = ps.expires
+			}
+			return
+		}
+	}
+	tab.ss = append(tab.ss, ps)
+}
+
+// lookup returns the forwarded searches that the response for the
+// search target st, received on the interface ifIndex, answers.
+func (tab *searchTable) lookup(st string, ifIndex int) []*pendingSearch {
+	tab.mu.Lock()
+	defer tab.mu.Unlock()
+	tab.expire(time.Now())
+	var ss []*pendingSearch
+	for _, s := range tab.ss {
+		if s.ifIndex != 0 && s.ifIndex == ifIndex {
+			continue // the requester receives responses directly
+		}
+		if s.st == "ssdp:all" || s.st == st {
+			ss = append(ss, s)
+		}
+	}
+	return ss
+}
+
+func (tab *searchTable) expire(now time.Time) {
+	i := 0
+	for _, s := range tab.ss {
+		if now.Before(s.expires) {
+			tab.ss[i] = s
+			i++
+		}
+	}
+	for j := i; j < len(tab.ss); j++ {
+		tab.ss[j] = nil
+	}
+	tab.ss = tab.ss[:i]
+}
+
+func (tab *searchTable) len() int {
+	tab.mu.Lock()
+	defer tab.mu.Unlock()
+	tab.expire(time.Now())
+	return len(tab.ss)
+}
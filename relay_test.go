@@ -0,0 +1,139 @@
+// Copyright 2014 Mikio Hara. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ssdp
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"net/http"
+	"testing"
+)
+
+func TestSearchRelay(t *testing.T) {
+	c := &recordConn{}
+	grp := &net.UDPAddr{IP: net.ParseIP(DefaultIPv4Group), Port: 1900}
+	mifs := []net.Interface{{Index: 1, Name: "in"}, {Index: 2, Name: "out"}}
+	var tab searchTable
+
+	for _, st := range []string{"ssdp:all", "upnp:rootdevice", "upnp:rootdevice"} {
+		hdr := make(http.Header)
+		hdr.Set("Man", `"ssdp:discover"`)
+		hdr.Set("Mx", "2")
+		hdr.Set("St", st)
+		p := &path{src: &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 50000}, dst: &net.UDPAddr{IP: grp.IP}, ifIndex: 1}
+		adv := newAdvertRedirector(c, mifs, grp, p, newAdvert(msearchMethod, grp.String(), hdr))
+		adv.srch = &tab
+		adv.WriteTo(grp, &mifs[1])
+		adv.WriteTo(grp, &mifs[1])
+	}
+	if n := tab.len(); n != 2 {
+		t.Fatalf("got %d entries; want 2", n)
+	}
+	if ss := tab.lookup("urn:schemas-upnp-org:device:MediaServer:1", 2); len(ss) != 1 {
+		t.Fatalf("got %d entries; want 1", len(ss))
+	}
+	if ss := tab.lookup("upnp:rootdevice", 1); len(ss) != 0 {
+		t.Fatalf("got %d entries; want 0", len(ss))
+	}
+
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewBufferString("HTTP/1.1 200 OK\r\nST: upnp:rootdevice\r\nUSN: uuid:x::upnp:rootdevice\r\n\r\n")), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &path{src: &net.UDPAddr{IP: net.IPv4(198, 51, 100, 1), Port: 1900}, dst: &net.UDPAddr{IP: net.IPv4(198, 51, 100, 2)}, ifIndex: 2}
+	resprdr := newResponseRedirector(c, mifs, grp, p, resp)
+	rdr := Redirector{}
+	c.dgs = nil
+	rdr.relay(resprdr, tab.lookup("upnp:rootdevice", 2))
+	dgs := c.datagrams()
+	if len(dgs) != 2 {
+		t.Fatalf("got %d datagrams; want 2", len(dgs))
+	}
+	for _, dg := range dgs {
+		if dg.dst.Port != 50000 || !bytes.Contains(dg.b, []byte("uuid:x::upnp:rootdevice")) {
+			t.Errorf("unexpected datagram to %v: %q", dg.dst, dg.b)
+		}
+	}
+}
+
+func TestSearchRelayDrop(t *testing.T) {
+	grp := &net.UDPAddr{IP: net.ParseIP(DefaultIPv4Group), Port: 1900}
+	mifs := []net.Interface{{Index: 1, Name: "in"}, {Index: 2, Name: "out"}}
+
+	for _, tt := range []struct {
+		rules   []ForwardingRule
+		relayed bool
+	}{
+		{[]ForwardingRule{{Methods: []string{"RESPONSE"}, USN: "uuid:x::*", Action: ActionDrop}, {Methods: []string{"RESPONSE"}, Action: ActionRewrite}}, false},
+		{[]ForwardingRule{{Methods: []string{"RESPONSE"}, Action: ActionRewrite, SetHeaders: map[string]string{"X-Rewritten": "yes"}}}, false},
+		{[]ForwardingRule{{Methods: []string{"RESPONSE"}, Action: ActionForward, Targets: []ForwardingTarget{{Addr: "198.51.100.3"}}}}, true},
+	} {
+		rh, err := NewRuleHandler(&ForwardingConfig{Rules: tt.rules})
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.ReadResponse(bufio.NewReader(bytes.NewBufferString("HTTP/1.1 200 OK\r\nST: upnp:rootdevice\r\nUSN: uuid:x::upnp:rootdevice\r\n\r\n")), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := &recordConn{}
+		src := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 50000}
+		var tab searchTable
+		tab.add(&pendingSearch{src: src, ifIndex: 1, st: "ssdp:all", reply: func(b []byte) (int, error) { return c.writeTo(b, src, nil) }}, "2")
+		p := &path{src: &net.UDPAddr{IP: net.IPv4(198, 51, 100, 1), Port: 1900}, dst: &net.UDPAddr{IP: net.IPv4(198, 51, 100, 2)}, ifIndex: 2}
+		resprdr := newResponseRedirector(c, mifs, grp, p, resp)
+		var rdr Redirector
+		rdr.redirectResponse(rh, resprdr, tab.lookup("upnp:rootdevice", 2))
+		var relayed bool
+		for _, dg := range c.datagrams() {
+			if dg.dst.Port == 50000 {
+				relayed = true
+			}
+		}
+		if relayed != tt.relayed {
+			t.Errorf("%+v: got %v; want %v", tt.rules, relayed, tt.relayed)
+		}
+	}
+}
+
+func TestSearchRelayConcurrentWrite(t *testing.T) {
+	c := &recordConn{}
+	grp := &net.UDPAddr{IP: net.ParseIP(DefaultIPv4Group), Port: 1900}
+	mifs := []net.Interface{{Index: 1, Name: "in"}, {Index: 2, Name: "out"}}
+	src := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 50000}
+	var tab searchTable
+	tab.add(&pendingSearch{src: src, ifIndex: 1, st: "ssdp:all", reply: func(b []byte) (int, error) { return c.writeTo(b, src, nil) }}, "2")
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewBufferString("HTTP/1.1 200 OK\r\nST: upnp:rootdevice\r\nUSN: uuid:x::upnp:rootdevice\r\n\r\nbody")), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &path{src: &net.UDPAddr{IP: net.IPv4(198, 51, 100, 1), Port: 1900}, dst: &net.UDPAddr{IP: net.IPv4(198, 51, 100, 2)}, ifIndex: 2}
+	resprdr := newResponseRedirector(c, mifs, grp, p, resp)
+	resprdr.guard, err = newLoopGuard()
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 10; i++ {
+			resprdr.WriteTo(&net.UDPAddr{IP: net.IPv4(198, 51, 100, 3), Port: 1900}, nil)
+		}
+	}()
+	for i := 0; i < 10; i++ {
+		(&Redirector{}).relay(resprdr, tab.lookup("upnp:rootdevice", 2))
+	}
+	<-done
+	dgs := c.datagrams()
+	if len(dgs) != 20 {
+		t.Fatalf("got %d datagrams; want 20", len(dgs))
+	}
+	for _, dg := range dgs {
+		if !bytes.Contains(dg.b, []byte("USN: uuid:x::upnp:rootdevice\r\n")) || !bytes.HasSuffix(dg.b, []byte("\r\n\r\nbody")) {
+			t.Errorf("unexpected datagram: %q", dg.b)
+		}
+	}
+}
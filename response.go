@@ -7,10 +7,13 @@ package ssdp
 import (
 	"bufio"
 	"bytes"
+	"errors"
 	"fmt"
-	"io"
+	"io/ioutil"
 	"net"
 	"net/http"
+	"sync"
+	"time"
 )
 
 func parseResponse(b []byte) (*http.Response, error) {
@@ -28,12 +31,40 @@ type response struct {
 	path *path // reverse path
 }
 
+// An OrderedHeaderWriter is implemented by the http.ResponseWriter
+// passed to the handler of Device. It allows the handler to control
+// the exact header fields of the response message.
+type OrderedHeaderWriter interface {
+	// OrderedHeader returns the ordered header that will be sent
+	// by WriteHeader. If it is not empty, it is used instead of
+	// the header returned by the Header method.
+	OrderedHeader() *Header
+}
+
+// DefaultMaxResponseSize is the default maximum size of response
+// messages written by handlers.
+const DefaultMaxResponseSize = 1280
+
+// ErrMessageTooLong is returned when a response message exceeds the
+// maximum size.
+var ErrMessageTooLong = errors.New("message too long")
+
+var errResponseSent = errors.New("response already sent")
+
+// A responseWriter buffers a response message written by a handler
+// and sends it as a single datagram when the handler returns or
+// flushes.
 type responseWriter struct {
 	response
-	hdr    http.Header // response header
-	wrthdr bool        // whether the header has been written
-	buf    bytes.Buffer
-	req    *http.Request
+	hdr     http.Header // response header
+	ohdr    Header      // ordered response header
+	wrthdr  bool        // whether the header has been written
+	flushed bool        // whether the response has been sent
+	err     error       // error on writing the header or body
+	max     int         // maximum message size
+	buf     bytes.Buffer
+	req     *http.Request
+	stats   *endpointStats
 }
 
 // Header implements the Header method of http.ResponseWriter
@@ -42,22 +73,100 @@ func (resp *responseWriter) Header() http.Header {
 	return resp.hdr
 }
 
-// Write implements the Write method of http.ResponseWriter interface.
+// OrderedHeader implements the OrderedHeader method of
+// OrderedHeaderWriter interface.
+func (resp *responseWriter) OrderedHeader() *Header {
+	return &resp.ohdr
+}
+
+// Write implements the Write method of http.ResponseWriter
+// interface. It appends b to the message body. It returns
+// ErrMessageTooLong when the message exceeds the maximum size; the
+// response is not sent then.
 func (resp *responseWriter) Write(b []byte) (int, error) {
+	if resp.flushed {
+		return 0, errResponseSent
+	}
 	if !resp.wrthdr {
 		resp.WriteHeader(http.StatusOK)
 	}
-	return resp.writeTo(b, resp.path.src)
+	if resp.buf.Len()+len(b) > resp.maxSize() {
+		if resp.err == nil {
+			resp.err = ErrMessageTooLong
+		}
+		return 0, ErrMessageTooLong
+	}
+	return resp.buf.Write(b)
 }
 
 // WriteHeader implements the WriteHeader method of
-// http.ResponseWriter interface.
+// http.ResponseWriter interface. The header is not sent until the
+// handler returns or flushes. The fields of the header map are
+// written with the names as set.
 func (resp *responseWriter) WriteHeader(code int) {
+	if resp.wrthdr || resp.flushed {
+		return
+	}
 	resp.wrthdr = true
 	fmt.Fprintf(&resp.buf, "%s %d %s\r\n", resp.req.Proto, code, http.StatusText(code))
-	resp.hdr.Write(&resp.buf)
+	if len(resp.ohdr) > 0 {
+		resp.err = resp.ohdr.Write(&resp.buf)
+	} else {
+		resp.err = headerAsIs(resp.hdr).Write(&resp.buf)
+	}
 	resp.buf.WriteString("\r\n")
-	resp.writeTo(resp.buf.Bytes(), resp.path.src)
+}
+
+// Flush implements the Flush method of http.Flusher interface.
+func (resp *responseWriter) Flush() {
+	resp.FlushError()
+}
+
+// FlushError sends the response message as a single datagram. The
+// following writes fail. It returns ErrMessageTooLong without sending
+// the message when the message exceeds the maximum size or a
+// previous write failed for the size, and the error of Header.Write
+// when the header contains an invalid field name.
+func (resp *responseWriter) FlushError() error {
+	if resp.flushed {
+		return nil
+	}
+	if !resp.wrthdr {
+		resp.WriteHeader(http.StatusOK)
+	}
+	resp.flushed = true
+	if resp.err != nil {
+		return resp.err
+	}
+	if resp.buf.Len() > resp.maxSize() {
+		return ErrMessageTooLong
+	}
+	if _, err := resp.writeTo(resp.buf.Bytes(), resp.path.src, nil); err != nil {
+		if ifi := interfaceByIndex(resp.mifs, resp.path.ifIndex); ifi != nil {
+			resp.stats.writeFailed(ifi.Name)
+		} else {
+			resp.stats.writeFailed("")
+		}
+		return err
+	}
+	resp.stats.sent(MethodResponse, "")
+	return nil
+}
+
+// finish sends the response message written by the handler unless
+// it has been sent.
+func (resp *responseWriter) finish() error {
+	if !resp.wrthdr || resp.flushed {
+		return nil
+	}
+	return resp.FlushError()
+}
+
+func (resp *responseWriter) maxSize() int {
+	if resp.max <= 0 {
+		return DefaultMaxResponseSize
+	}
+	return resp.max
 }
 
 func newResponseWriter(conn conn, mifs []net.Interface, grp *net.UDPAddr, path *path, req *http.Request) *responseWriter {
@@ -71,8 +180,8 @@ func newResponseWriter(conn conn, mifs []net.Interface, grp *net.UDPAddr, path *
 		req: req,
 	}
 	resp.path.dst.Port = grp.Port
-	if ipv6LinkLocal(path.src.IP) {
-		path.src.Zone = interfaceByIndex(resp.mifs, resp.path.ifIndex).Name
+	if ifi := interfaceByIndex(resp.mifs, resp.path.ifIndex); ifi != nil && ipv6LinkLocal(path.src.IP) {
+		path.src.Zone = ifi.Name
 	}
 	return resp
 }
@@ -80,8 +189,21 @@ func newResponseWriter(conn conn, mifs []net.Interface, grp *net.UDPAddr, path *
 // A ResponseRedirector represents a SSDP response message redirector.
 type ResponseRedirector struct {
 	response
-	resp *http.Response
-	buf  bytes.Buffer
+	resp  *http.Response
+	body  []byte      // response body, read on the first write
+	read  sync.Once   // reads the response body
+	raw   []byte      // received message
+	at    time.Time   // receive time
+	devs  []Deviation // deviations found in received message
+	guard *loopGuard  // loop prevention
+	drop  bool        // whether the response is not relayed
+}
+
+// Drop prevents the redirector from relaying the response to the
+// requesters of forwarded M-SEARCH messages. It must be called before
+// the RedirectResponse method of the handler returns.
+func (rdr *ResponseRedirector) Drop() {
+	rdr.drop = true
 }
 
 // Header returns the HTTP header map that will be sent by WriteTo
@@ -90,19 +212,58 @@ func (rdr *ResponseRedirector) Header() http.Header {
 	return rdr.resp.Header
 }
 
+// Raw returns the received SSDP response message as is.
+func (rdr *ResponseRedirector) Raw() []byte {
+	return rdr.raw
+}
+
+// ReceivedTime returns the time when the SSDP response message was
+// received.
+func (rdr *ResponseRedirector) ReceivedTime() time.Time {
+	return rdr.at
+}
+
+// Deviations returns the deviations from the protocol found in the
+// received SSDP response message. It returns nil when the message
+// conforms to the protocol or is parsed in ParseStrict mode.
+func (rdr *ResponseRedirector) Deviations() []Deviation {
+	return rdr.devs
+}
+
 // WriteTo writes the SSDP response message. The outbound network
 // interface ifi is used for sending multicast messages. It uses the
-// system assigned multicast network interface when ifi is nil.
+// system assigned multicast network interface when ifi is nil. The
+// selection of ifi doesn't affect concurrent writes on the same
+// endpoint. WriteTo may be called multiple times to write the same
+// message to multiple destinations. The header fields keep the order
+// and casing of the received message; added fields follow them. The
+// message carries a private hop header for the loop prevention.
 func (rdr *ResponseRedirector) WriteTo(dst *net.UDPAddr, ifi *net.Interface) (int, error) {
-	if ifi != nil {
-		rdr.SetMulticastInterface(ifi)
+	b, err := rdr.marshal()
+	if err != nil {
+		return 0, err
+	}
+	return rdr.writeTo(b, dst, ifi)
+}
+
+func (rdr *ResponseRedirector) marshal() ([]byte, error) {
+	rdr.read.Do(func() {
+		rdr.body, _ = ioutil.ReadAll(rdr.resp.Body)
+		rdr.resp.Body.Close()
+	})
+	// The header and buffer are private to the call as the handler
+	// may write the response while the redirector relays it.
+	hdr := rdr.resp.Header.Clone()
+	rdr.guard.stamp(hdr)
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%s %s\r\n", rdr.resp.Proto, rdr.resp.Status)
+	if err := parseHeader(rdr.raw).merge(hdr, "").Write(&buf); err != nil {
+		return nil, err
 	}
-	fmt.Fprintf(&rdr.buf, "%s %s\r\n", rdr.resp.Proto, rdr.resp.Status)
-	rdr.resp.Header.Write(&rdr.buf)
-	rdr.buf.WriteString("\r\n")
-	io.Copy(&rdr.buf, rdr.resp.Body)
-	rdr.resp.Body.Close()
-	return rdr.writeTo(rdr.buf.Bytes(), dst)
+	buf.WriteString("\r\n")
+	buf.Write(rdr.body)
+	rdr.guard.record(buf.Bytes())
+	return buf.Bytes(), nil
 }
 
 // ForwardPath returns the destination address of the SSDP response
@@ -127,8 +288,8 @@ func newResponseRedirector(conn conn, mifs []net.Interface, grp *net.UDPAddr, pa
 		resp: resp,
 	}
 	rdr.path.dst.Port = grp.Port
-	if ipv6LinkLocal(path.src.IP) {
-		path.src.Zone = interfaceByIndex(mifs, path.ifIndex).Name
+	if ifi := interfaceByIndex(mifs, path.ifIndex); ifi != nil && ipv6LinkLocal(path.src.IP) {
+		path.src.Zone = ifi.Name
 	}
 	return rdr
 }
@@ -0,0 +1,131 @@
+// Copyright 2014 Mikio Hara. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ssdp
+
+import (
+	"bytes"
+	"net"
+	"net/http"
+	"testing"
+)
+
+func TestResponseWriter(t *testing.T) {
+	grp := &net.UDPAddr{IP: net.ParseIP(DefaultIPv4Group), Port: 1900}
+	newWriter := func(c conn) *responseWriter {
+		p := &path{src: &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 50000}, dst: &net.UDPAddr{IP: grp.IP}}
+		return newResponseWriter(c, nil, grp, p, newAdvert(msearchMethod, grp.String(), make(http.Header)))
+	}
+
+	c := &recordConn{}
+	w := newWriter(c)
+	w.Header().Set("St", "upnp:rootdevice")
+	w.Header()["usn"] = []string{"uuid:a::upnp:rootdevice"}
+	w.Write([]byte("hello, "))
+	w.Header().Set("Usn", "ignored")
+	w.Write([]byte("world"))
+	if dgs := c.datagrams(); len(dgs) != 0 {
+		t.Fatalf("got %d datagrams before finish; want 0", len(dgs))
+	}
+	if err := w.finish(); err != nil {
+		t.Fatal(err)
+	}
+	dgs := c.datagrams()
+	if len(dgs) != 1 {
+		t.Fatalf("got %d datagrams; want 1", len(dgs))
+	}
+	if want := "HTTP/1.1 200 OK\r\nSt: upnp:rootdevice\r\nusn: uuid:a::upnp:rootdevice\r\n\r\nhello, world"; string(dgs[0].b) != want {
+		t.Errorf("got %q; want %q", dgs[0].b, want)
+	}
+	if dgs[0].dst.Port != 50000 {
+		t.Errorf("got %v; want port 50000", dgs[0].dst)
+	}
+
+	c = &recordConn{}
+	w = newWriter(c)
+	w.WriteHeader(http.StatusOK)
+	w.Flush()
+	if _, err := w.Write([]byte("late")); err == nil {
+		t.Error("got nil; want error")
+	}
+	if err := w.finish(); err != nil || len(c.datagrams()) != 1 {
+		t.Errorf("got %v, %d datagrams; want nil, 1", err, len(c.datagrams()))
+	}
+
+	c = &recordConn{}
+	w = newWriter(c)
+	w.max = 64
+	if _, err := w.Write(bytes.Repeat([]byte{'a'}, 64)); err != ErrMessageTooLong {
+		t.Errorf("got %v; want %v", err, ErrMessageTooLong)
+	}
+	w.Header().Set("Server", string(bytes.Repeat([]byte{'a'}, 64)))
+	if err := w.finish(); err != ErrMessageTooLong || len(c.datagrams()) != 0 {
+		t.Errorf("got %v, %d datagrams; want %v, 0", err, len(c.datagrams()), ErrMessageTooLong)
+	}
+
+	c = &recordConn{}
+	w = newWriter(c)
+	w.max = 64
+	w.Write([]byte("fits"))
+	if _, err := w.Write(bytes.Repeat([]byte{'a'}, 64)); err != ErrMessageTooLong {
+		t.Errorf("got %v; want %v", err, ErrMessageTooLong)
+	}
+	w.Write([]byte("fits"))
+	if err := w.FlushError(); err != ErrMessageTooLong || len(c.datagrams()) != 0 {
+		t.Errorf("got %v, %d datagrams; want %v, 0", err, len(c.datagrams()), ErrMessageTooLong)
+	}
+	if err := w.finish(); err != nil || len(c.datagrams()) != 0 {
+		t.Errorf("got %v, %d datagrams; want nil, 0", err, len(c.datagrams()))
+	}
+
+	c = &recordConn{}
+	w = newWriter(c)
+	w.max = 32
+	w.Header().Set("Server", string(bytes.Repeat([]byte{'a'}, 64)))
+	w.WriteHeader(http.StatusOK)
+	if err := w.finish(); err != ErrMessageTooLong || len(c.datagrams()) != 0 {
+		t.Errorf("got %v, %d datagrams; want %v, 0", err, len(c.datagrams()), ErrMessageTooLong)
+	}
+
+	c = &recordConn{}
+	if err := newWriter(c).finish(); err != nil || len(c.datagrams()) != 0 {
+		t.Errorf("got %v, %d datagrams; want nil, 0", err, len(c.datagrams()))
+	}
+}
+
+func TestDeviceRespond(t *testing.T) {
+	c := &recordConn{}
+	grp := &net.UDPAddr{IP: net.ParseIP(DefaultIPv4Group), Port: 1900}
+	dev := &Device{conn: c, group: grp, stats: newEndpointStats(), MaxResponseSize: 80}
+	p := &path{src: &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 50000}, dst: &net.UDPAddr{IP: grp.IP, Port: grp.Port}}
+	req := newAdvert(msearchMethod, grp.String(), make(http.Header))
+	if err := dev.Respond(req, Header{{"ST", "upnp:rootdevice"}}); err == nil {
+		t.Error("responded to request not received by device")
+	}
+	req = withInbound(req, &inbound{path: p, grp: grp})
+
+	for _, st := range []string{"upnp:rootdevice", "urn:schemas-upnp-org:device:MediaServer:1"} {
+		if err := dev.Respond(req, Header{{"ST", st}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := dev.Respond(req, Header{{"SERVER", string(bytes.Repeat([]byte{'a'}, 80))}}); err != ErrMessageTooLong {
+		t.Errorf("got %v; want %v", err, ErrMessageTooLong)
+	}
+	if err := dev.Respond(req, Header{{"X\r\nInjected", "v"}}); err == nil {
+		t.Error("responded with invalid header field name")
+	}
+	dgs := c.datagrams()
+	if len(dgs) != 2 {
+		t.Fatalf("got %d datagrams; want 2", len(dgs))
+	}
+	for i, want := range []string{"HTTP/1.1 200 OK\r\nST: upnp:rootdevice\r\n\r\n", "HTTP/1.1 200 OK\r\nST: urn:schemas-upnp-org:device:MediaServer:1\r\n\r\n"} {
+		if string(dgs[i].b) != want || dgs[i].dst.Port != 50000 {
+			t.Errorf("#%d: got %q to %v; want %q to port 50000", i, dgs[i].b, dgs[i].dst, want)
+		}
+	}
+	if n := dev.Stats().Sent[MessageKind{Method: MethodResponse}]; n != 2 {
+		t.Errorf("got %d sent responses; want 2", n)
+	}
+}
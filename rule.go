@@ -0,0 +1,324 @@
+// Copyright 2014 Mikio Hara. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ssdp
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"log/slog"
+	"net"
+	"net/http"
+	pathpkg "path"
+	"strconv"
+	"strings"
+)
+
+// A ForwardingAction represents an action of forwarding rule.
+type ForwardingAction string
+
+const (
+	// ActionForward rewrites the headers and forwards the message
+	// to the targets. No further rules are evaluated.
+	ActionForward ForwardingAction = "forward"
+
+	// ActionDrop drops the message. No further rules are
+	// evaluated.
+	ActionDrop ForwardingAction = "drop"
+
+	// ActionRewrite rewrites the headers and continues to
+	// evaluate the following rules.
+	ActionRewrite ForwardingAction = "rewrite"
+)
+
+// MethodResponse is a pseudo method that matches SSDP response
+// messages in forwarding rules.
+const MethodResponse = "RESPONSE"
+
+// A ForwardingTarget represents a destination of forwarded messages.
+type ForwardingTarget struct {
+	// Interface specifies an outbound network interface name. If
+	// it is empty, the system assigned network interface will be
+	// used.
+	Interface string
+
+	// Addr specifies a destination address in the form of
+	// "host:port" or "host". If the port is missing, the port of
+	// the redirector group will be used. If it is empty, the
+	// destination address of the inbound advertisement message
+	// will be used. It must not be empty for response messages.
+	Addr string
+}
+
+// A ForwardingRule represents a forwarding rule. An empty match
+// condition matches any message.
+type ForwardingRule struct {
+	Interfaces []string // inbound network interface names
+	Sources    []string // source address prefixes in CIDR notation or IP addresses
+	Methods    []string // NOTIFY, M-SEARCH or RESPONSE
+
+	// NT, ST and USN specify patterns of the corresponding header
+	// values in the syntax of path.Match.
+	NT  string
+	ST  string
+	USN string
+
+	Action     ForwardingAction
+	Targets    []ForwardingTarget // targets for ActionForward
+	SetHeaders map[string]string  // headers to be set or replaced
+	DelHeaders []string           // headers to be removed
+}
+
+// A ForwardingConfig represents a set of forwarding rules. The rules
+// are evaluated in order. Messages that match no rule are dropped.
+type ForwardingConfig struct {
+	Rules []ForwardingRule
+}
+
+// A RuleHandler represents a rule-driven redirect handler. It
+// implements RedirectHandler.
+type RuleHandler struct {
+	// ErrorLog specified an optional logger for errors. If it is
+	// nil, logging goes to os.Stderr via the log package's
+	// standard logger.
+	ErrorLog *log.Logger
+
+	// Logger optionally specifies a structured logger. If it is
+	// not nil, it is used instead of ErrorLog.
+	Logger *slog.Logger
+
+	rules []rule
+}
+
+type ruleTarget struct {
+	ifi  *net.Interface
+	ip   net.IP
+	port int
+}
+
+// A rule represents a forwarding rule compiled from a copy of
+// ForwardingRule.
+type rule struct {
+	ifnames    map[string]bool
+	prefixes   []*net.IPNet
+	methods    map[string]bool
+	nt, st     string // patterns of header values
+	usn        string
+	action     ForwardingAction
+	targets    []ruleTarget
+	setHeaders map[string]string
+	delHeaders []string
+}
+
+// NewRuleHandler returns a new rule-driven redirect handler.
+func NewRuleHandler(cfg *ForwardingConfig) (*RuleHandler, error) {
+	rh := &RuleHandler{}
+	for i := range cfg.Rules {
+		r, err := newRule(&cfg.Rules[i])
+		if err != nil {
+			return nil, fmt.Errorf("rule %d: %v", i, err)
+		}
+		rh.rules = append(rh.rules, *r)
+	}
+	return rh, nil
+}
+
+func newRule(fr *ForwardingRule) (*rule, error) {
+	r := &rule{nt: fr.NT, st: fr.ST, usn: fr.USN, action: fr.Action, delHeaders: append([]string(nil), fr.DelHeaders...)}
+	switch fr.Action {
+	case ActionForward, ActionDrop, ActionRewrite:
+	default:
+		return nil, fmt.Errorf("unknown action: %q", fr.Action)
+	}
+	if len(fr.Interfaces) > 0 {
+		r.ifnames = make(map[string]bool)
+		for _, name := range fr.Interfaces {
+			r.ifnames[name] = true
+		}
+	}
+	for _, s := range fr.Sources {
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("malformed source: %s", s)
+			}
+			if ip.To4() != nil {
+				s += "/32"
+			} else {
+				s += "/128"
+			}
+		}
+		_, prefix, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		r.prefixes = append(r.prefixes, prefix)
+	}
+	if len(fr.Methods) > 0 {
+		r.methods = make(map[string]bool)
+		for _, m := range fr.Methods {
+			m = strings.ToUpper(m)
+			switch m {
+			case notifyMethod, msearchMethod, MethodResponse:
+			default:
+				return nil, fmt.Errorf("unknown method: %s", m)
+			}
+			r.methods[m] = true
+		}
+	}
+	for _, pat := range []string{fr.NT, fr.ST, fr.USN} {
+		if _, err := pathpkg.Match(pat, ""); err != nil {
+			return nil, fmt.Errorf("malformed pattern %q: %v", pat, err)
+		}
+	}
+	for _, ft := range fr.Targets {
+		var t ruleTarget
+		if ft.Interface != "" {
+			ifi, err := net.InterfaceByName(ft.Interface)
+			if err != nil {
+				return nil, err
+			}
+			t.ifi = ifi
+		}
+		if ft.Addr != "" {
+			host, port := ft.Addr, ""
+			if h, p, err := net.SplitHostPort(ft.Addr); err == nil {
+				host, port = h, p
+			}
+			if t.ip = net.ParseIP(host); t.ip == nil {
+				return nil, fmt.Errorf("malformed address: %s", ft.Addr)
+			}
+			if port != "" {
+				n, err := strconv.Atoi(port)
+				if err != nil || n <= 0 || n > 65535 {
+					return nil, fmt.Errorf("malformed address: %s", ft.Addr)
+				}
+				t.port = n
+			}
+		}
+		r.targets = append(r.targets, t)
+	}
+	if fr.Action == ActionForward && len(r.targets) == 0 {
+		return nil, errors.New("no forwarding target")
+	}
+	if len(fr.SetHeaders) > 0 {
+		r.setHeaders = make(map[string]string, len(fr.SetHeaders))
+		for k, v := range fr.SetHeaders {
+			r.setHeaders[k] = v
+		}
+	}
+	return r, nil
+}
+
+func (r *rule) match(method string, src *net.UDPAddr, ifi *net.Interface, hdr http.Header) bool {
+	if r.ifnames != nil && (ifi == nil || !r.ifnames[ifi.Name]) {
+		return false
+	}
+	if len(r.prefixes) > 0 {
+		ok := false
+		for _, prefix := range r.prefixes {
+			if prefix.Contains(src.IP) {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return false
+		}
+	}
+	if r.methods != nil && !r.methods[method] {
+		return false
+	}
+	for _, f := range []struct{ pat, key string }{{r.nt, "Nt"}, {r.st, "St"}, {r.usn, "Usn"}} {
+		if f.pat == "" {
+			continue
+		}
+		if ok, _ := pathpkg.Match(f.pat, hdr.Get(f.key)); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *rule) rewrite(hdr http.Header) {
+	for _, k := range r.delHeaders {
+		hdr.Del(k)
+	}
+	for k, v := range r.setHeaders {
+		hdr.Set(k, v)
+	}
+}
+
+// evaluate applies the rules to the message and returns the matched
+// forwarding rule. It returns nil when the message must be dropped.
+func (rh *RuleHandler) evaluate(method string, src *net.UDPAddr, ifi *net.Interface, hdr http.Header) *rule {
+	for i := range rh.rules {
+		r := &rh.rules[i]
+		if !r.match(method, src, ifi, hdr) {
+			continue
+		}
+		switch r.action {
+		case ActionDrop:
+			return nil
+		case ActionRewrite:
+			r.rewrite(hdr)
+		case ActionForward:
+			r.rewrite(hdr)
+			return r
+		}
+	}
+	return nil
+}
+
+// RedirectAdvert implements the RedirectAdvert method of
+// RedirectHandler interface.
+func (rh *RuleHandler) RedirectAdvert(rdr *AdvertRedirector) {
+	src, ifi := rdr.ReversePath()
+	r := rh.evaluate(rdr.Method(), src, ifi, rdr.Header())
+	if r == nil {
+		return
+	}
+	for _, t := range r.targets {
+		dst := *rdr.ForwardPath()
+		if t.ip != nil {
+			dst.IP = t.ip
+		}
+		if t.port != 0 {
+			dst.Port = t.port
+		}
+		if _, err := rdr.WriteTo(&dst, t.ifi); err != nil {
+			rh.logEvent(logRecord{level: slog.LevelWarn, kind: LogKindWrite, msg: "forward advert failed", peer: src, method: rdr.Method(), hdr: rdr.Header(), err: err})
+		}
+	}
+}
+
+// RedirectResponse implements the RedirectResponse method of
+// RedirectHandler interface. A dropped response is not relayed to
+// the requesters of forwarded searches either.
+func (rh *RuleHandler) RedirectResponse(rdr *ResponseRedirector) {
+	src, ifi := rdr.ReversePath()
+	r := rh.evaluate(MethodResponse, src, ifi, rdr.Header())
+	if r == nil {
+		rdr.Drop()
+		return
+	}
+	for _, t := range r.targets {
+		if t.ip == nil {
+			rh.logEvent(logRecord{level: slog.LevelWarn, kind: LogKindWrite, msg: "forward response failed", peer: src, method: MethodResponse, hdr: rdr.Header(), err: errors.New("no destination address")})
+			continue
+		}
+		dst := net.UDPAddr{IP: t.ip, Port: t.port}
+		if dst.Port == 0 {
+			dst.Port = rdr.ForwardPath().Port
+		}
+		if _, err := rdr.WriteTo(&dst, t.ifi); err != nil {
+			rh.logEvent(logRecord{level: slog.LevelWarn, kind: LogKindWrite, msg: "forward response failed", peer: src, method: MethodResponse, hdr: rdr.Header(), err: err})
+		}
+	}
+}
+
+func (rh *RuleHandler) logEvent(r logRecord) {
+	writeLog(rh.Logger, rh.ErrorLog, &r)
+}
@@ -0,0 +1,94 @@
+// Copyright 2014 Mikio Hara. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ssdp
+
+import (
+	"bytes"
+	"net"
+	"net/http"
+	"testing"
+)
+
+func TestRuleHandler(t *testing.T) {
+	ifi := loopbackInterface()
+	if ifi == nil {
+		ift, err := net.Interfaces()
+		if err != nil || len(ift) == 0 {
+			t.Skip("no available network interface found")
+		}
+		ifi = &ift[0]
+	}
+	cfg := ForwardingConfig{
+		Rules: []ForwardingRule{
+			{Sources: []string{"192.0.2.0/24"}, Methods: []string{"notify"}, NT: "urn:schemas-upnp-org:device:*", Action: ActionRewrite, SetHeaders: map[string]string{"X-Rewritten": "yes"}, DelHeaders: []string{"Server"}},
+			{Methods: []string{"NOTIFY"}, USN: "uuid:bad*", Action: ActionDrop},
+			{Methods: []string{"NOTIFY", "M-SEARCH"}, Action: ActionForward, Targets: []ForwardingTarget{{Interface: ifi.Name}, {Addr: "239.255.255.250:1901"}}},
+			{Methods: []string{"RESPONSE"}, Action: ActionForward, Targets: []ForwardingTarget{{Addr: "192.0.2.1"}}},
+		},
+	}
+	rh, err := NewRuleHandler(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The handler must not be affected by the later changes of the
+	// configuration.
+	cfg.Rules[0].NT = "*"
+	cfg.Rules[0].SetHeaders["X-Rewritten"] = "no"
+	cfg.Rules[0].DelHeaders[0] = "Nt"
+	cfg.Rules[1].Action = ActionForward
+
+	grp := &net.UDPAddr{IP: net.ParseIP(DefaultIPv4Group), Port: 1900}
+	for _, tt := range []struct {
+		nt, usn   string
+		rewritten bool
+		forwarded bool
+	}{
+		{"urn:schemas-upnp-org:device:MediaServer:1", "uuid:good", true, true},
+		{"urn:schemas-upnp-org:service:ContentDirectory:1", "uuid:good", false, true},
+		{"urn:schemas-upnp-org:device:MediaServer:1", "uuid:bad", true, false},
+	} {
+		c := &recordConn{}
+		hdr := make(http.Header)
+		hdr.Set("Nt", tt.nt)
+		hdr.Set("Usn", tt.usn)
+		hdr.Set("Server", "test")
+		p := &path{src: &net.UDPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 1900}, dst: &net.UDPAddr{IP: grp.IP}, ifIndex: ifi.Index}
+		rh.RedirectAdvert(newAdvertRedirector(c, []net.Interface{*ifi}, grp, p, newAdvert(notifyMethod, grp.String(), hdr)))
+		dgs := c.datagrams()
+		if !tt.forwarded {
+			if len(dgs) != 0 {
+				t.Errorf("%v: got %d datagrams; want 0", tt, len(dgs))
+			}
+			continue
+		}
+		if len(dgs) != 2 {
+			t.Fatalf("%v: got %d datagrams; want 2", tt, len(dgs))
+		}
+		if dgs[0].ifi == nil || dgs[0].ifi.Name != ifi.Name || dgs[0].dst.Port != 1900 {
+			t.Errorf("%v: unexpected first datagram to %v on %v", tt, dgs[0].dst, dgs[0].ifi)
+		}
+		if dgs[1].dst.Port != 1901 {
+			t.Errorf("%v: unexpected second datagram to %v", tt, dgs[1].dst)
+		}
+		if rewritten := bytes.Contains(dgs[0].b, []byte("X-Rewritten: yes")); rewritten != tt.rewritten {
+			t.Errorf("%v: got %v; want %v", tt, rewritten, tt.rewritten)
+		}
+		if rewritten := !bytes.Contains(dgs[0].b, []byte("SERVER: test")); rewritten != tt.rewritten {
+			t.Errorf("%v: got %v; want %v", tt, rewritten, tt.rewritten)
+		}
+	}
+
+	for _, cfg := range []ForwardingConfig{
+		{Rules: []ForwardingRule{{Action: "accept"}}},
+		{Rules: []ForwardingRule{{Action: ActionForward}}},
+		{Rules: []ForwardingRule{{Action: ActionDrop, Sources: []string{"192.0.2"}}}},
+		{Rules: []ForwardingRule{{Action: ActionDrop, NT: "[urn"}}},
+		{Rules: []ForwardingRule{{Action: ActionDrop, Methods: []string{"GET"}}}},
+	} {
+		if _, err := NewRuleHandler(&cfg); err == nil {
+			t.Errorf("%+v: got nil; want error", cfg)
+		}
+	}
+}
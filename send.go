@@ -0,0 +1,57 @@
+// Copyright 2014 Mikio Hara. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ssdp
+
+import (
+	"net"
+	"strings"
+)
+
+// A SendResult represents a result of sending a SSDP message on a
+// multicast network interface.
+type SendResult struct {
+	Interface net.Interface // outbound network interface
+	N         int           // number of bytes written
+	Err       error         // error, nil on success
+}
+
+// A SendError represents an error on sending a SSDP message on some
+// of the multicast network interfaces.
+type SendError struct {
+	Results []SendResult // results on all the attempted interfaces
+}
+
+func (e *SendError) Error() string {
+	var ss []string
+	for _, r := range e.Results {
+		if r.Err != nil {
+			ss = append(ss, r.Interface.Name+": "+r.Err.Error())
+		}
+	}
+	return "send failed on " + strings.Join(ss, ", ")
+}
+
+func sendResults(rs []writeResult) []SendResult {
+	srs := make([]SendResult, 0, len(rs))
+	for _, r := range rs {
+		srs = append(srs, SendResult{Interface: r.ifi, N: r.n, Err: r.err})
+	}
+	return srs
+}
+
+// sendError returns the error on sending a message. The error err is
+// returned as is when sending failed on all the interfaces and strict
+// is false.
+func sendError(srs []SendResult, strict bool, err error) error {
+	if !strict {
+		return err
+	}
+	for _, r := range srs {
+		if r.Err != nil {
+			return &SendError{Results: srs}
+		}
+	}
+	return err
+}
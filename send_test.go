@@ -0,0 +1,198 @@
+// Copyright 2014 Mikio Hara. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ssdp
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"testing"
+)
+
+func TestSendError(t *testing.T) {
+	errUnreach := errors.New("unreachable")
+	partial := sendResults([]writeResult{
+		{ifi: net.Interface{Index: 1, Name: "eth0"}, n: 100},
+		{ifi: net.Interface{Index: 2, Name: "eth1"}, err: errUnreach},
+	})
+	if len(partial) != 2 || partial[0].N != 100 || partial[1].Interface.Name != "eth1" || partial[1].Err != errUnreach {
+		t.Fatalf("unexpected results: %+v", partial)
+	}
+	if err := sendError(partial, false, nil); err != nil {
+		t.Errorf("got %v; want nil", err)
+	}
+	err := sendError(partial, true, nil)
+	serr, ok := err.(*SendError)
+	if !ok {
+		t.Fatalf("got %v; want *SendError", err)
+	}
+	if len(serr.Results) != 2 || serr.Error() != "send failed on eth1: unreachable" {
+		t.Errorf("unexpected error: %v", serr)
+	}
+
+	all := sendResults([]writeResult{{ifi: net.Interface{Index: 2, Name: "eth1"}, err: errUnreach}})
+	if err := sendError(all, false, errUnreach); err != errUnreach {
+		t.Errorf("got %v; want %v", err, errUnreach)
+	}
+	if err := sendError(all, true, errUnreach); err == nil {
+		t.Error("got nil; want error")
+	}
+}
+
+func TestNotifyResults(t *testing.T) {
+	ln := Listener{LocalPort: "1901"}
+	dev, err := ln.ListenDevice(nil)
+	if err != nil {
+		t.Skip(err)
+	}
+	defer dev.Close()
+	dev.StrictSend = true
+
+	hdr := make(http.Header)
+	hdr.Set("Nt", "upnp:rootdevice")
+	hdr.Set("Nts", "ssdp:alive")
+	hdr.Set("Usn", "uuid:--::upnp:rootdevice")
+	if err := dev.Notify(hdr, dev.Interfaces()); err != nil {
+		t.Fatal(err)
+	}
+	pm, err := dev.PrepareNotify(Notification{Header: HeaderFromHTTP(hdr), Interfaces: dev.Interfaces()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srs, err := dev.NotifyPrepared(pm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(srs) != len(dev.Interfaces()) {
+		t.Fatalf("got %d results; want %d", len(srs), len(dev.Interfaces()))
+	}
+	for _, sr := range srs {
+		if sr.Err != nil || sr.N == 0 {
+			t.Errorf("unexpected result on %v: %d, %v", sr.Interface.Name, sr.N, sr.Err)
+		}
+	}
+}
+
+func TestNotifyPreparedBatch(t *testing.T) {
+	mifs, err := interfaces(nil, ipv4Unicast)
+	if err != nil || len(mifs) == 0 {
+		t.Skip("no available multicast network interface found")
+	}
+	c := &recordConn{}
+	grp := &net.UDPAddr{IP: net.ParseIP(DefaultIPv4Group), Port: 1900}
+	dev := &Device{conn: c, group: grp, unicast: ipv4Unicast}
+	var pms []*PreparedMessage
+	var usns []string
+	for _, usn := range []string{"uuid:a::upnp:rootdevice", "uuid:b::upnp:rootdevice"} {
+		hdr := Header{{Name: "NT", Value: "upnp:rootdevice"}, {Name: "NTS", Value: "ssdp:alive"}, {Name: "USN", Value: usn}}
+		pm, err := dev.PrepareNotify(Notification{Header: hdr, Interfaces: mifs})
+		if err != nil {
+			t.Fatal(err)
+		}
+		pms = append(pms, pm)
+		for range pm.Interfaces() {
+			usns = append(usns, usn)
+		}
+	}
+	srs, err := dev.NotifyPrepared(pms...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dgs := c.datagrams()
+	if len(srs) != len(usns) || len(dgs) != len(usns) {
+		t.Fatalf("got %d results, %d datagrams; want %d, %d", len(srs), len(dgs), len(usns), len(usns))
+	}
+	for i, dg := range dgs {
+		ifi := mifs[i%len(mifs)]
+		want := "NOTIFY * HTTP/1.1\r\nHOST: 239.255.255.250:1900\r\nNT: upnp:rootdevice\r\nNTS: ssdp:alive\r\nUSN: " + usns[i] + "\r\n\r\n"
+		if string(dg.b) != want || dg.ifi.Name != ifi.Name {
+			t.Errorf("#%d: got %q on %v; want %q on %v", i, dg.b, dg.ifi.Name, want, ifi.Name)
+		}
+		if srs[i].Interface.Name != ifi.Name || srs[i].N != len(dg.b) {
+			t.Errorf("#%d: unexpected result: %+v", i, srs[i])
+		}
+	}
+}
+
+func TestPrepareNotify(t *testing.T) {
+	mifs, err := interfaces(nil, ipv4Unicast)
+	if err != nil || len(mifs) == 0 {
+		t.Skip("no available multicast network interface found")
+	}
+	ifi := &mifs[0]
+	c := &recordConn{}
+	grp := &net.UDPAddr{IP: net.ParseIP(DefaultIPv4Group), Port: 1900}
+	dev := &Device{conn: c, group: grp, unicast: ipv4Unicast}
+	hdr := Header{{Name: "NT", Value: "upnp:rootdevice"}, {Name: "NTS", Value: "ssdp:alive"}, {Name: "USN", Value: "uuid:a::upnp:rootdevice"}}
+	pm, err := dev.PrepareNotify(Notification{Header: hdr, Interfaces: []net.Interface{*ifi}, Location: func(ifi *net.Interface) string { return "http://" + ifi.Name + "/dd.xml" }})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hdr[2].Value = "uuid:b::upnp:rootdevice"
+	byebye, err := dev.PrepareNotify(Notification{Header: Header{{Name: "NT", Value: "upnp:rootdevice"}, {Name: "NTS", Value: "ssdp:byebye"}}, Interfaces: []net.Interface{*ifi}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ift := pm.Interfaces(); len(ift) != 1 || ift[0].Name != ifi.Name {
+		t.Fatalf("got %v; want [%v]", ift, ifi.Name)
+	}
+
+	for i := 0; i < 2; i++ {
+		srs, err := dev.NotifyPrepared(pm, byebye)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(srs) != 2 || srs[0].Interface.Name != ifi.Name || srs[1].Interface.Name != ifi.Name {
+			t.Fatalf("unexpected results: %+v", srs)
+		}
+	}
+	dgs := c.datagrams()
+	if len(dgs) != 4 {
+		t.Fatalf("got %d datagrams; want 4", len(dgs))
+	}
+	for i, dg := range dgs {
+		want := "NOTIFY * HTTP/1.1\r\nHOST: 239.255.255.250:1900\r\nNT: upnp:rootdevice\r\nNTS: ssdp:alive\r\nUSN: uuid:a::upnp:rootdevice\r\nLOCATION: http://" + ifi.Name + "/dd.xml\r\n\r\n"
+		if i%2 == 1 {
+			want = "NOTIFY * HTTP/1.1\r\nHOST: 239.255.255.250:1900\r\nNT: upnp:rootdevice\r\nNTS: ssdp:byebye\r\n\r\n"
+		}
+		if string(dg.b) != want || dg.dst != grp || dg.ifi.Name != ifi.Name {
+			t.Errorf("#%d: got %q to %v on %v; want %q", i, dg.b, dg.dst, dg.ifi.Name, want)
+		}
+	}
+
+	other := &Device{conn: c, group: grp, unicast: ipv4Unicast}
+	if _, err := other.NotifyPrepared(pm); err == nil {
+		t.Error("sent message prepared by another device")
+	}
+}
+
+func TestNotifyPreparedAllocs(t *testing.T) {
+	mifs, err := interfaces(nil, ipv4Unicast)
+	if err != nil || len(mifs) == 0 {
+		t.Skip("no available multicast network interface found")
+	}
+	ifi := &mifs[0]
+	c, dst := newLoopbackUDP4Conn(t)
+	defer c.Close()
+	dev := &Device{conn: c, group: dst, unicast: ipv4Unicast}
+	hdr := Header{{Name: "NT", Value: "upnp:rootdevice"}, {Name: "NTS", Value: "ssdp:alive"}, {Name: "USN", Value: "uuid:a::upnp:rootdevice"}}
+	pm, err := dev.PrepareNotify(Notification{Header: hdr, Interfaces: []net.Interface{*ifi}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	prepared := testing.AllocsPerRun(100, func() {
+		if _, err := dev.NotifyPrepared(pm); err != nil {
+			t.Fatal(err)
+		}
+	})
+	header := testing.AllocsPerRun(100, func() {
+		if err := dev.Notify(hdr.HTTPHeader(), []net.Interface{*ifi}); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if prepared >= header {
+		t.Errorf("got %v allocs; want fewer than %v", prepared, header)
+	}
+}
@@ -13,7 +13,19 @@ const (
 	DefaultPort = "1900"
 )
 
+const (
+	DefaultIPv4EventGroup = "239.255.255.246"
+
+	DefaultIPv6LinkLocalEventGroup = "ff02::130"
+	DefaultIPv6SiteLocalEventGroup = "ff05::130"
+
+	DefaultEventPort = "7900"
+)
+
 const (
 	notifyMethod  = "NOTIFY"
 	msearchMethod = "M-SEARCH"
+
+	subscribeMethod   = "SUBSCRIBE"
+	unsubscribeMethod = "UNSUBSCRIBE"
 )
@@ -0,0 +1,194 @@
+// Copyright 2014 Mikio Hara. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ssdp
+
+import (
+	"sync"
+	"time"
+)
+
+// A MessageKind represents a kind of SSDP message.
+type MessageKind struct {
+	Method string // NOTIFY, M-SEARCH or RESPONSE
+	NTS    string // notification sub type of NOTIFY message
+}
+
+// A LatencyHistogram represents a distribution of latencies.
+type LatencyHistogram struct {
+	// Bounds holds the inclusive upper bounds of the buckets in
+	// ascending order.
+	Bounds []time.Duration
+
+	// Counts holds the number of samples in each bucket. The last
+	// element counts the samples greater than the last bound.
+	Counts []uint64
+
+	Count uint64        // number of samples
+	Sum   time.Duration // sum of samples
+}
+
+// A Stats represents a snapshot of statistics of an endpoint.
+type Stats struct {
+	Received map[MessageKind]uint64 // received messages
+	Sent     map[MessageKind]uint64 // sent messages
+
+	ParseFailures       uint64 // inbound messages failed to parse
+	UnknownDestinations uint64 // inbound messages to unknown destinations
+
+	// WriteFailures holds the number of write failures indexed
+	// by outbound network interface name.
+	WriteFailures map[string]uint64
+
+	HandlerPanics uint64 // panics in handlers
+
+	// SearchLatency holds the distribution of latencies between
+	// sending a M-SEARCH message and receiving the responses.
+	SearchLatency LatencyHistogram
+}
+
+var searchLatencyBounds = []time.Duration{
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2500 * time.Millisecond,
+	5 * time.Second,
+}
+
+// An endpointStats maintains statistics of an endpoint.
+type endpointStats struct {
+	mu sync.Mutex
+	st Stats
+}
+
+func newEndpointStats() *endpointStats {
+	return &endpointStats{
+		st: Stats{
+			Received:      make(map[MessageKind]uint64),
+			Sent:          make(map[MessageKind]uint64),
+			WriteFailures: make(map[string]uint64),
+			SearchLatency: LatencyHistogram{
+				Bounds: searchLatencyBounds,
+				Counts: make([]uint64, len(searchLatencyBounds)+1),
+			},
+		},
+	}
+}
+
+func (es *endpointStats) received(method, nts string) {
+	if es == nil {
+		return
+	}
+	es.mu.Lock()
+	es.st.Received[MessageKind{Method: method, NTS: nts}]++
+	es.mu.Unlock()
+}
+
+func (es *endpointStats) sent(method, nts string) {
+	if es == nil {
+		return
+	}
+	es.mu.Lock()
+	es.st.Sent[MessageKind{Method: method, NTS: nts}]++
+	es.mu.Unlock()
+}
+
+// wrote counts the message written on the multicast network
+// interfaces as sent when it is written on any of them.
+func (es *endpointStats) wrote(method, nts string, rs []writeResult) {
+	if es == nil {
+		return
+	}
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	ok := false
+	for _, r := range rs {
+		if r.err != nil {
+			es.st.WriteFailures[r.ifi.Name]++
+			continue
+		}
+		ok = true
+	}
+	if ok {
+		es.st.Sent[MessageKind{Method: method, NTS: nts}]++
+	}
+}
+
+func (es *endpointStats) writeFailed(ifname string) {
+	if es == nil {
+		return
+	}
+	es.mu.Lock()
+	es.st.WriteFailures[ifname]++
+	es.mu.Unlock()
+}
+
+func (es *endpointStats) parseFailed() {
+	if es == nil {
+		return
+	}
+	es.mu.Lock()
+	es.st.ParseFailures++
+	es.mu.Unlock()
+}
+
+func (es *endpointStats) unknownDestination() {
+	if es == nil {
+		return
+	}
+	es.mu.Lock()
+	es.st.UnknownDestinations++
+	es.mu.Unlock()
+}
+
+func (es *endpointStats) panicked() {
+	if es == nil {
+		return
+	}
+	es.mu.Lock()
+	es.st.HandlerPanics++
+	es.mu.Unlock()
+}
+
+func (es *endpointStats) searchLatency(d time.Duration) {
+	if es == nil {
+		return
+	}
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	h := &es.st.SearchLatency
+	i := 0
+	for ; i < len(h.Bounds) && d > h.Bounds[i]; i++ {
+	}
+	h.Counts[i]++
+	h.Count++
+	h.Sum += d
+}
+
+func (es *endpointStats) snapshot() Stats {
+	if es == nil {
+		return Stats{}
+	}
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	st := es.st
+	st.Received = make(map[MessageKind]uint64, len(es.st.Received))
+	for k, v := range es.st.Received {
+		st.Received[k] = v
+	}
+	st.Sent = make(map[MessageKind]uint64, len(es.st.Sent))
+	for k, v := range es.st.Sent {
+		st.Sent[k] = v
+	}
+	st.WriteFailures = make(map[string]uint64, len(es.st.WriteFailures))
+	for k, v := range es.st.WriteFailures {
+		st.WriteFailures[k] = v
+	}
+	st.SearchLatency.Counts = append([]uint64(nil), es.st.SearchLatency.Counts...)
+	return st
+}
@@ -0,0 +1,67 @@
+// Copyright 2014 Mikio Hara. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ssdp
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEndpointStats(t *testing.T) {
+	es := newEndpointStats()
+	es.received(notifyMethod, "ssdp:alive")
+	es.received(notifyMethod, "ssdp:alive")
+	es.received(MethodResponse, "")
+	es.wrote(msearchMethod, "", []writeResult{{ifi: net.Interface{Name: "eth0"}, err: errors.New("unreachable")}, {ifi: net.Interface{Name: "eth1"}, n: 1}})
+	es.wrote(msearchMethod, "", []writeResult{{ifi: net.Interface{Name: "eth0"}, err: errors.New("unreachable")}})
+	es.parseFailed()
+	es.unknownDestination()
+	es.panicked()
+	es.searchLatency(5 * time.Millisecond)
+	es.searchLatency(300 * time.Millisecond)
+	es.searchLatency(10 * time.Second)
+
+	st := es.snapshot()
+	es.received(notifyMethod, "ssdp:alive")
+	if n := st.Received[MessageKind{Method: notifyMethod, NTS: "ssdp:alive"}]; n != 2 {
+		t.Errorf("got %d; want 2", n)
+	}
+	if n := st.Sent[MessageKind{Method: msearchMethod}]; n != 1 {
+		t.Errorf("got %d; want 1", n)
+	}
+	if n := st.WriteFailures["eth0"]; n != 2 {
+		t.Errorf("got %d; want 2", n)
+	}
+	if st.ParseFailures != 1 || st.UnknownDestinations != 1 || st.HandlerPanics != 1 {
+		t.Errorf("unexpected counters: %+v", st)
+	}
+	h := st.SearchLatency
+	if h.Count != 3 || h.Counts[0] != 1 || h.Counts[5] != 1 || h.Counts[len(h.Counts)-1] != 1 {
+		t.Errorf("unexpected histogram: %+v", h)
+	}
+
+	var me MetricsExporter
+	me.Register("cp\"1", es.snapshot)
+	rec := httptest.NewRecorder()
+	me.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	for _, s := range []string{
+		`ssdp_messages_received_total{endpoint="cp\"1",method="NOTIFY",nts="ssdp:alive"} 3`,
+		`ssdp_messages_sent_total{endpoint="cp\"1",method="M-SEARCH",nts=""} 1`,
+		`ssdp_write_failures_total{endpoint="cp\"1",interface="eth0"} 2`,
+		`ssdp_search_latency_seconds_bucket{endpoint="cp\"1",le="0.01"} 1`,
+		`ssdp_search_latency_seconds_bucket{endpoint="cp\"1",le="0.5"} 2`,
+		`ssdp_search_latency_seconds_bucket{endpoint="cp\"1",le="+Inf"} 3`,
+		`ssdp_search_latency_seconds_count{endpoint="cp\"1"} 3`,
+	} {
+		if !strings.Contains(rec.Body.String(), s+"\n") {
+			t.Errorf("%q not found in\n%s", s, rec.Body.String())
+		}
+	}
+}